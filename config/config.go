@@ -38,6 +38,58 @@ type Config struct {
 	RedisURL string `toml:"redis-url" env:"REDIS_URL"`
 	WebURL   string `toml:"web-url" env:"HTEE_WEB_URL"`
 	WebToken string `toml:"web-token" env:"HTEE_WEB_TOKEN"`
+
+	RedisTLSCA         string `toml:"redis-tls-ca" env:"HTEE_REDIS_TLS_CA"`
+	RedisTLSCert       string `toml:"redis-tls-cert" env:"HTEE_REDIS_TLS_CERT"`
+	RedisTLSKey        string `toml:"redis-tls-key" env:"HTEE_REDIS_TLS_KEY"`
+	RedisTLSSkipVerify bool   `toml:"redis-tls-skip-verify" env:"HTEE_REDIS_TLS_SKIP_VERIFY"`
+
+	RedisMaxIdle        int `toml:"redis-max-idle" env:"HTEE_REDIS_MAX_IDLE"`
+	RedisMaxActive      int `toml:"redis-max-active" env:"HTEE_REDIS_MAX_ACTIVE"`
+	RedisIdleTimeout    int `toml:"redis-idle-timeout" env:"HTEE_REDIS_IDLE_TIMEOUT"`       // seconds
+	RedisConnectTimeout int `toml:"redis-connect-timeout" env:"HTEE_REDIS_CONNECT_TIMEOUT"` // milliseconds
+	RedisReadTimeout    int `toml:"redis-read-timeout" env:"HTEE_REDIS_READ_TIMEOUT"`       // milliseconds
+	RedisWriteTimeout   int `toml:"redis-write-timeout" env:"HTEE_REDIS_WRITE_TIMEOUT"`     // milliseconds
+	RedisRetries        int `toml:"redis-retries" env:"HTEE_REDIS_RETRIES"`                 // negative disables
+	RedisRetryDelay     int `toml:"redis-retry-delay" env:"HTEE_REDIS_RETRY_DELAY"`         // milliseconds
+	RedisPoolTimeout    int `toml:"redis-pool-timeout" env:"HTEE_REDIS_POOL_TIMEOUT"`       // milliseconds
+
+	RedisSentinels      []string `toml:"redis-sentinels" env:"HTEE_REDIS_SENTINELS"`
+	RedisSentinelMaster string   `toml:"redis-sentinel-master" env:"HTEE_REDIS_SENTINEL_MASTER"`
+	RedisCluster        bool     `toml:"redis-cluster" env:"HTEE_REDIS_CLUSTER"`
+	RedisShards         []string `toml:"redis-shards" env:"HTEE_REDIS_SHARDS"`
+	RedisReplicas       []string `toml:"redis-replicas" env:"HTEE_REDIS_REPLICAS"`
+
+	RedactPatterns []string `toml:"redact-patterns" env:"HTEE_REDACT_PATTERNS"`
+	RedactTokens   bool     `toml:"redact-tokens" env:"HTEE_REDACT_TOKENS"`
+	RedactWindow   int      `toml:"redact-window" env:"HTEE_REDACT_WINDOW"`
+
+	ViewerBuffer int    `toml:"viewer-buffer" env:"HTEE_VIEWER_BUFFER"`
+	SlowViewer   string `toml:"slow-viewer" env:"HTEE_SLOW_VIEWER"`
+	SnapshotPage int    `toml:"snapshot-page" env:"HTEE_SNAPSHOT_PAGE"`
+
+	FlushInterval int `toml:"flush-interval" env:"HTEE_FLUSH_INTERVAL"` // milliseconds
+	FlushSize     int `toml:"flush-size" env:"HTEE_FLUSH_SIZE"`
+
+	MaxStreamSize int `toml:"max-stream-size" env:"HTEE_MAX_STREAM_SIZE"`
+	SegmentSize   int `toml:"segment-size" env:"HTEE_SEGMENT_SIZE"`
+
+	Compression string `toml:"compression" env:"HTEE_COMPRESSION"`
+
+	LeaseTTL           int    `toml:"lease-ttl" env:"HTEE_LEASE_TTL"` // seconds, negative disables
+	WriterConflict     string `toml:"writer-conflict" env:"HTEE_WRITER_CONFLICT"`
+	WriterQueueTimeout int    `toml:"writer-queue-timeout" env:"HTEE_WRITER_QUEUE_TIMEOUT"` // seconds
+	ResumeTimeout      int    `toml:"resume-timeout" env:"HTEE_RESUME_TIMEOUT"`             // seconds, negative disables
+
+	SpoolDir  string `toml:"spool-dir" env:"HTEE_SPOOL_DIR"`
+	SpoolSize int    `toml:"spool-size" env:"HTEE_SPOOL_SIZE"`
+
+	WebhookPath string `toml:"webhook-path" env:"HTEE_WEBHOOK_PATH"` // relative to web-url, empty disables
+	WebhookDir  string `toml:"webhook-dir" env:"HTEE_WEBHOOK_DIR"`   // required with webhook-path
+
+	WatchWebhookHosts []string `toml:"watch-webhook-hosts" env:"HTEE_WATCH_WEBHOOK_HOSTS"` // allowed at private addresses
+
+	MetricsAddress string `toml:"metrics-address" env:"HTEE_METRICS_ADDRESS"`
 }
 
 func (c *Config) Addr() string {
@@ -105,6 +157,16 @@ func (c *Config) loadEnv() error {
 				return fmt.Errorf("Parse error: %s: %s", field.Tag.Get("env"), err)
 			}
 			value.Field(i).SetFloat(newValue)
+		case reflect.Slice:
+			if field.Type.Elem().Kind() != reflect.String {
+				continue
+			}
+
+			parts := strings.Split(v, ",")
+			for j := range parts {
+				parts[j] = strings.TrimSpace(parts[j])
+			}
+			value.Field(i).Set(reflect.ValueOf(parts))
 		}
 	}
 	return nil
@@ -9,13 +9,15 @@ import (
 
 	"github.com/htee/hteed/config"
 	"github.com/htee/hteed/server"
+	"github.com/htee/hteed/stream"
 )
 
 var usage = strings.TrimSpace(`
 hteed
 
 Usage:
-    hteed
+    hteed [options]
+    hteed [options] rebalance [-n | --dry-run]
     hteed -h | --help
 
 Options:
@@ -25,6 +27,9 @@ Options:
     -r, --redis-url URL     Redis server connection string
     -w, --web-url URL       Upstream htee-web url
     -h, --help              Show help
+
+Commands:
+    rebalance               Move streams onto the redis shard they hash to
 `)
 
 func main() {
@@ -46,6 +51,11 @@ func main() {
 	}
 	c := loadConfig(configFile)
 
+	if fs.Arg(0) == "rebalance" {
+		rebalance(c, fs.Args()[1:])
+		return
+	}
+
 	if err := config.Configure(c); err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
 		os.Exit(1)
@@ -54,6 +64,34 @@ func main() {
 	server.ListenAndServe(c.Addr())
 }
 
+// rebalance only connects to the shards, so that it starts none of the
+// daemon's background work, such as replaying the spools a running daemon
+// may share.
+func rebalance(c *config.Config, args []string) {
+	var dryRun bool
+
+	fs := flag.NewFlagSet("rebalance", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.BoolVar(&dryRun, "n", false, "")
+	fs.BoolVar(&dryRun, "dry-run", false, "")
+
+	if err := fs.Parse(args); err != nil {
+		fmt.Printf("%s\n\n", usage)
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(1)
+	}
+
+	if err := stream.ConfigureShards(c); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+
+	if err := stream.Rebalance(os.Stdout, dryRun); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
 func loadConfig(configFile string) *config.Config {
 	cnf := &config.Config{
 		Address:  "0.0.0.0",
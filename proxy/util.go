@@ -8,8 +8,16 @@ import (
 	"net"
 	"net/http"
 	"strings"
+
+	gcontext "github.com/htee/hteed/Godeps/_workspace/src/github.com/gorilla/context"
 )
 
+type key int
+
+// RedactKey is the request context key holding the literal values that the
+// upstream asked to be redacted from a recording in its rewrite message.
+const RedactKey key = 0
+
 func Copy(w http.ResponseWriter, r *http.Response) error {
 	wh := w.Header()
 
@@ -27,6 +35,7 @@ func RewriteRequest(req *http.Request, res *http.Response) (*http.Request, error
 	var message struct {
 		Method, Path, Body string
 		Headers            map[string]string
+		Redact             []string
 	}
 
 	dec := json.NewDecoder(res.Body)
@@ -60,6 +69,10 @@ func RewriteRequest(req *http.Request, res *http.Response) (*http.Request, error
 		r.Body = req.Body
 	}
 
+	if len(message.Redact) > 0 {
+		gcontext.Set(r, RedactKey, message.Redact)
+	}
+
 	return r, nil
 }
 
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(enc, ";")
+		if strings.TrimSpace(parts[0]) != "gzip" {
+			continue
+		}
+
+		for _, param := range parts[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) != 2 || kv[0] != "q" {
+				continue
+			}
+
+			if q, err := strconv.ParseFloat(kv[1], 64); err == nil && q == 0 {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// gzipWriter compresses playback data, flushing the compressor after every
+// write so that live data isn't held back in it.
+type gzipWriter struct {
+	gz *gzip.Writer
+}
+
+func (w gzipWriter) Write(p []byte) (int, error) {
+	n, err := w.gz.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	return n, w.gz.Flush()
+}
@@ -0,0 +1,25 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	for header, want := range map[string]bool{
+		"":                   false,
+		"gzip":               true,
+		"deflate, gzip":      true,
+		"gzip;q=0.5, br":     true,
+		"gzip;q=0":           false,
+		"gzip; q=0.000, br":  false,
+		"identity, x-gzip":   false,
+		"br;q=1.0, gzip;q=1": true,
+	} {
+		req := &http.Request{Header: http.Header{"Accept-Encoding": {header}}}
+
+		if got := acceptsGzip(req); got != want {
+			t.Errorf("acceptsGzip(%q) is %t, want %t", header, got, want)
+		}
+	}
+}
@@ -2,16 +2,22 @@ package server
 
 import (
 	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"expvar"
 	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"path"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/htee/hteed/Godeps/_workspace/src/code.google.com/p/go.net/context"
+	gcontext "github.com/htee/hteed/Godeps/_workspace/src/github.com/gorilla/context"
 	"github.com/stretchr/graceful"
 
 	"github.com/htee/hteed/Godeps/_workspace/src/github.com/codegangsta/negroni"
@@ -29,14 +35,29 @@ func init() {
 
 func configureServer(cnf *config.Config) error {
 	Server = &server{
-		logger: log.New(os.Stdout, "[server] ", log.LstdFlags),
+		logger:        log.New(os.Stdout, "[server] ", log.LstdFlags),
+		maxStreamSize: int64(cnf.MaxStreamSize),
+		metricsAddr:   cnf.MetricsAddress,
+	}
+
+	Server.ctx, Server.stop = context.WithCancel(context.Background())
+
+	if Server.maxStreamSize <= 0 {
+		Server.maxStreamSize = 1 << 20
 	}
 
 	return nil
 }
 
 type server struct {
-	logger *log.Logger
+	logger        *log.Logger
+	maxStreamSize int64
+	metricsAddr   string
+
+	// ctx is cancelled when the server shuts down, ending the work that
+	// outlives its request.
+	ctx  context.Context
+	stop context.CancelFunc
 
 	gracefulServer *graceful.Server
 }
@@ -46,7 +67,10 @@ func ListenAndServe(addr string) {
 	defer Server.logger.Printf("Finished listening on %s", addr)
 
 	srv := &graceful.Server{
-		ShutdownInitiated: func() { Server.logger.Printf("Shutdown initiated on %s", addr) },
+		ShutdownInitiated: func() {
+			Server.logger.Printf("Shutdown initiated on %s", addr)
+			Server.stop()
+		},
 
 		Server: &http.Server{
 			Addr:    addr,
@@ -56,6 +80,10 @@ func ListenAndServe(addr string) {
 
 	Server.gracefulServer = srv
 
+	if Server.metricsAddr != "" {
+		go Server.serveMetrics()
+	}
+
 	listener, err := socket.CreateTCPSocket("tcp4", addr)
 	if err != nil {
 		Server.logger.Fatal(err.Error())
@@ -64,6 +92,16 @@ func ListenAndServe(addr string) {
 	srv.Serve(listener)
 }
 
+// serveMetrics serves the expvar metrics, such as the depth of the recording
+// spool, on a separate address.
+func (s *server) serveMetrics() {
+	s.logger.Printf("Serving metrics on %s", s.metricsAddr)
+
+	if err := http.ListenAndServe(s.metricsAddr, expvar.Handler()); err != nil {
+		s.logger.Printf("Metrics listener failed: %s", err)
+	}
+}
+
 func (s *server) ServerHandler() http.Handler {
 	n := negroni.New()
 	n.Use(negroni.HandlerFunc(s.upstreamMiddleware))
@@ -77,20 +115,197 @@ func (s *server) ServerHandler() http.Handler {
 func (s *server) handleRequest(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	defer gcontext.Clear(r)
 
 	ctx = newContext(ctx, r)
 
 	switch r.Method {
 	case "GET":
-		s.playbackStream(ctx, w, r)
+		if _, ok := r.URL.Query()["watches"]; ok {
+			s.listWatches(w, r)
+		} else if owner, ok := listing(r.URL.Path); ok {
+			if _, events := r.URL.Query()["events"]; events {
+				s.streamEvents(ctx, w, r, owner)
+			} else if _, follow := r.URL.Query()["follow"]; follow {
+				s.followOwner(ctx, w, r, owner)
+			} else {
+				s.listStreams(w, r, owner)
+			}
+		} else if _, ok := r.URL.Query()["markers"]; ok {
+			s.listMarkers(w, r)
+		} else if _, ok := r.URL.Query()["group"]; ok {
+			s.playbackGroup(ctx, w, r)
+		} else {
+			s.playbackStream(ctx, w, r)
+		}
 	case "POST":
-		s.recordStream(ctx, w, r)
+		if _, ok := r.URL.Query()["append"]; ok {
+			s.appendStream(ctx, w, r)
+		} else if r.URL.Query().Get("copy") != "" {
+			s.copyStream(ctx, w, r)
+		} else if _, ok := r.URL.Query()["marker"]; ok {
+			s.markStream(w, r)
+		} else if _, ok := r.URL.Query()["watch"]; ok {
+			s.addWatch(w, r)
+		} else if group := r.URL.Query().Get("group"); group != "" {
+			s.recordStep(ctx, w, r, group)
+		} else if _, ok := r.URL.Query()["group"]; ok {
+			s.changeGroup(w, r)
+		} else {
+			s.recordStream(ctx, w, r)
+		}
+	case "PUT":
+		if r.Header.Get(resumeTokenHeader) != "" {
+			s.resumeStream(ctx, w, r)
+		} else {
+			s.replaceStream(ctx, w, r)
+		}
+	case "PATCH":
+		s.appendStream(ctx, w, r)
 	case "DELETE":
-		s.deleteStream(ctx, w, r)
+		if _, ok := r.URL.Query()["watch"]; ok {
+			s.removeWatch(w, r)
+		} else {
+			s.deleteStream(ctx, w, r)
+		}
 	}
 }
 
+// recordStream records the request body onto the end of the stream, which is
+// created if it doesn't exist yet.
 func (s *server) recordStream(ctx context.Context, res http.ResponseWriter, req *http.Request) {
+	s.record(ctx, res, req, func(ctx context.Context) (*stream.Stream, error) {
+		return stream.Open(ctx, req.URL.Path)
+	})
+}
+
+// recordStep records the stream as the next step of the group.
+func (s *server) recordStep(ctx context.Context, res http.ResponseWriter, req *http.Request, group string) {
+	s.record(ctx, res, req, func(ctx context.Context) (*stream.Stream, error) {
+		return stream.OpenStep(ctx, req.URL.Path, group)
+	})
+}
+
+// changeGroup creates the group at the request path, or closes it with the
+// close parameter.
+func (s *server) changeGroup(res http.ResponseWriter, req *http.Request) {
+	_, closing := req.URL.Query()["close"]
+
+	var err error
+	if closing {
+		err = stream.CloseGroup(req.URL.Path)
+	} else {
+		err = stream.CreateGroup(req.URL.Path)
+	}
+
+	switch err {
+	case nil:
+	case stream.ErrNoGroup:
+		http.Error(res, err.Error(), http.StatusNotFound)
+		return
+	case stream.ErrGroupExists, stream.ErrGroupClosed:
+		http.Error(res, err.Error(), http.StatusConflict)
+		return
+	default:
+		s.handleError(res, req, err)
+		return
+	}
+
+	if closing {
+		res.WriteHeader(http.StatusNoContent)
+	} else {
+		res.Header().Set("Location", req.URL.Path)
+		res.WriteHeader(http.StatusCreated)
+	}
+}
+
+// appendStream reopens an existing stream to record more data onto its end.
+func (s *server) appendStream(ctx context.Context, res http.ResponseWriter, req *http.Request) {
+	s.record(ctx, res, req, func(ctx context.Context) (*stream.Stream, error) {
+		return stream.Reopen(ctx, req.URL.Path)
+	})
+}
+
+// replaceStream records the stream over its existing contents.
+func (s *server) replaceStream(ctx context.Context, res http.ResponseWriter, req *http.Request) {
+	s.record(ctx, res, req, func(ctx context.Context) (*stream.Stream, error) {
+		return stream.Replace(ctx, req.URL.Path)
+	})
+}
+
+// copyStream copies the stream named by the copy parameter to the request
+// path, truncated at the offset parameter if there is one. With the follow
+// parameter, the copy keeps following a stream that's still being recorded,
+// in the background.
+func (s *server) copyStream(ctx context.Context, res http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+
+	end := int64(-1)
+	if offset := query.Get("offset"); offset != "" {
+		var err error
+		if end, err = strconv.ParseInt(offset, 10, 64); err != nil || end < 0 {
+			http.Error(res, "Invalid copy offset", http.StatusBadRequest)
+			return
+		}
+	}
+
+	_, follow := query["follow"]
+	if follow {
+		// The copy outlives the request, until the server shuts down or
+		// another writer takes over the copy's lease.
+		ctx = s.ctx
+	}
+
+	cp, err := stream.Copy(ctx, query.Get("copy"), req.URL.Path, end, follow)
+	switch err {
+	case nil:
+	case stream.ErrNoStream:
+		http.Error(res, err.Error(), http.StatusNotFound)
+		return
+	case stream.ErrForeignCopy:
+		http.Error(res, err.Error(), http.StatusForbidden)
+		return
+	case stream.ErrStreamExists, stream.ErrWriterConflict:
+		http.Error(res, err.Error(), http.StatusConflict)
+		return
+	default:
+		s.handleError(res, req, err)
+		return
+	}
+
+	res.Header().Set("Location", req.URL.Path)
+
+	if follow {
+		res.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	<-cp.Done()
+	if cp.Err != nil {
+		s.handleError(res, req, cp.Err)
+		return
+	}
+
+	res.WriteHeader(http.StatusCreated)
+}
+
+// resumeStream carries on a recording whose connection dropped, from the
+// offset the recorder believes was stored.
+func (s *server) resumeStream(ctx context.Context, res http.ResponseWriter, req *http.Request) {
+	token := req.Header.Get(resumeTokenHeader)
+
+	offset, err := strconv.ParseInt(req.Header.Get(resumeOffsetHeader), 10, 64)
+	if err != nil {
+		http.Error(res, "Resuming requires the "+resumeOffsetHeader+" header", http.StatusBadRequest)
+		return
+	}
+
+	s.record(ctx, res, req, func(ctx context.Context) (*stream.Stream, error) {
+		return stream.Resume(ctx, req.URL.Path, token, offset)
+	})
+}
+
+func (s *server) record(ctx context.Context, res http.ResponseWriter, req *http.Request, open func(context.Context) (*stream.Stream, error)) {
 	name := req.URL.Path
 
 	conn, hw, err := res.(http.Hijacker).Hijack()
@@ -102,13 +317,53 @@ func (s *server) recordStream(ctx context.Context, res http.ResponseWriter, req
 	defer conn.Close()
 	defer s.closeHijacked(conn)
 
-	if err := writeContinue(hw, name); err != nil {
+	if values, ok := ctx.Value(proxy.RedactKey).([]string); ok {
+		ctx = stream.WithRedactions(ctx, values)
+	}
+
+	in, err := open(ctx)
+	if offsetErr, ok := err.(stream.ResumeOffsetError); ok {
+		offset := resumeOffsetHeader + ": " + strconv.FormatInt(offsetErr.Received, 10) + "\r\n"
+		if err := writeConflict(hw, err.Error(), offset); err != nil {
+			s.handleError(res, req, err)
+		}
+		return
+	} else if err == stream.ErrWriterConflict || err == stream.ErrNotResumable ||
+		err == stream.ErrNoGroup || err == stream.ErrGroupClosed {
+		if err := writeConflict(hw, err.Error()); err != nil {
+			s.handleError(res, req, err)
+		}
+		return
+	} else if err == stream.ErrNoStream {
+		if err := writeError(hw, "404 Not Found", err.Error()); err != nil {
+			s.handleError(res, req, err)
+		}
+		return
+	} else if err != nil {
+		s.handleError(res, req, err)
+		return
+	}
+
+	// The size cap holds across appends to the stream.
+	remaining := in.Remaining(s.maxStreamSize)
+	if remaining <= 0 {
+		// The stream is finished as it is.
+		in.Record(&io.LimitedReader{R: req.Body, N: 0})
+		<-in.Done()
+
+		if err := writeError(hw, "413 Request Entity Too Large", "Stream is at its maximum size"); err != nil {
+			s.handleError(res, req, err)
+		}
+		return
+	}
+
+	if err := writeContinue(hw, name, in.Token()); err != nil {
+		in.Cancel()
 		s.handleError(res, req, err)
 		return
 	}
 
-	reader := &io.LimitedReader{R: req.Body, N: 1 << 20}
-	in := stream.In(ctx, name, reader)
+	in.Record(&io.LimitedReader{R: req.Body, N: remaining})
 
 	select {
 	case <-in.Done():
@@ -122,10 +377,16 @@ func (s *server) recordStream(ctx context.Context, res http.ResponseWriter, req
 	}
 }
 
-func writeContinue(bw *bufio.ReadWriter, loc string) error {
+const (
+	resumeTokenHeader  = "X-Htee-Resume-Token"
+	resumeOffsetHeader = "X-Htee-Resume-Offset"
+)
+
+func writeContinue(bw *bufio.ReadWriter, loc, token string) error {
 	return writeResponse(bw,
 		"HTTP/1.1 100 Continue\r\n",
-		"Location: "+loc+"\r\n\r\n")
+		"Location: "+loc+"\r\n",
+		resumeTokenHeader+": "+token+"\r\n\r\n")
 }
 
 func writeNoContent(bw *bufio.ReadWriter) error {
@@ -135,6 +396,20 @@ func writeNoContent(bw *bufio.ReadWriter) error {
 		"Connection: close\r\n\r\n")
 }
 
+func writeConflict(bw *bufio.ReadWriter, msg string, headers ...string) error {
+	return writeError(bw, "409 Conflict", msg, headers...)
+}
+
+func writeError(bw *bufio.ReadWriter, status, msg string, headers ...string) error {
+	return writeResponse(bw, append(append([]string{
+		"HTTP/1.1 " + status + "\r\n",
+		"Content-Type: text/plain; charset=utf-8\r\n",
+		"Content-Length: " + strconv.Itoa(len(msg)+1) + "\r\n"},
+		headers...),
+		"Connection: close\r\n\r\n",
+		msg+"\n")...)
+}
+
 func writeResponse(bw *bufio.ReadWriter, body ...string) error {
 	for _, chunk := range body {
 		if _, err := bw.WriteString(chunk); err != nil {
@@ -156,19 +431,288 @@ func (s *server) deleteStream(ctx context.Context, res http.ResponseWriter, req
 	}
 }
 
+// listing returns the owner whose streams the path lists, as in /owner/.
+func listing(path string) (string, bool) {
+	owner := strings.TrimSuffix(strings.TrimPrefix(path, "/"), "/")
+	if owner == "" || strings.Contains(owner, "/") || !strings.HasSuffix(path, "/") {
+		return "", false
+	}
+
+	return owner, true
+}
+
+// listStreams lists the owner's streams, newest first, as JSON. The limit,
+// before, last and state parameters page through and filter the streams, and
+// the next field holds the URL of the next page if there is one.
+func (s *server) listStreams(res http.ResponseWriter, req *http.Request, owner string) {
+	query := req.URL.Query()
+
+	var opts stream.ListOptions
+	if limit := query.Get("limit"); limit != "" {
+		var err error
+		if opts.Limit, err = strconv.Atoi(limit); err != nil {
+			http.Error(res, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if before := query.Get("before"); before != "" {
+		var err error
+		if opts.Before, err = time.Parse(time.RFC3339Nano, before); err != nil {
+			http.Error(res, "Invalid before time", http.StatusBadRequest)
+			return
+		}
+	}
+
+	opts.Last = query.Get("last")
+
+	for _, name := range query["state"] {
+		state, ok := stream.ParseState(name)
+		if !ok {
+			http.Error(res, "Invalid state "+name, http.StatusBadRequest)
+			return
+		}
+
+		opts.States = append(opts.States, state)
+	}
+
+	infos, more, err := stream.List(owner, opts)
+	if err != nil {
+		s.handleError(res, req, err)
+		return
+	}
+
+	body := struct {
+		Streams []stream.Info `json:"streams"`
+		Next    string        `json:"next,omitempty"`
+	}{Streams: infos}
+
+	if body.Streams == nil {
+		body.Streams = []stream.Info{}
+	}
+
+	if more {
+		last := infos[len(infos)-1]
+		query.Set("before", last.Created.Format(time.RFC3339Nano))
+		query.Set("last", last.Name)
+		body.Next = req.URL.Path + "?" + query.Encode()
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(body)
+}
+
+// markStream adds the marker named by the marker parameter to the stream, at
+// the offset parameter, or at the data recorded around the time parameter,
+// or else at the end of the stream.
+func (s *server) markStream(res http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+
+	m := stream.Marker{Name: query.Get("marker"), Offset: -1}
+	if m.Name == "" {
+		http.Error(res, "Missing marker name", http.StatusBadRequest)
+		return
+	}
+
+	if offset := query.Get("offset"); offset != "" {
+		var err error
+		if m.Offset, err = strconv.ParseInt(offset, 10, 64); err != nil || m.Offset < 0 {
+			http.Error(res, "Invalid marker offset", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if at := query.Get("time"); at != "" {
+		var err error
+		if m.Time, err = time.Parse(time.RFC3339Nano, at); err != nil {
+			http.Error(res, "Invalid marker time", http.StatusBadRequest)
+			return
+		}
+	}
+
+	m, err := stream.Mark(req.URL.Path, m)
+	switch err {
+	case nil:
+	case stream.ErrNoStream:
+		http.Error(res, err.Error(), http.StatusNotFound)
+		return
+	default:
+		s.handleError(res, req, err)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusCreated)
+	json.NewEncoder(res).Encode(m)
+}
+
+// listMarkers lists the stream's markers as JSON, by offset.
+func (s *server) listMarkers(res http.ResponseWriter, req *http.Request) {
+	markers, err := stream.Markers(req.URL.Path)
+	if err != nil {
+		s.handleError(res, req, err)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(struct {
+		Markers []stream.Marker `json:"markers"`
+	}{markers})
+}
+
+// watchTarget returns the watched stream, or the owner for a listing path.
+func watchTarget(path string) string {
+	if owner, ok := listing(path); ok {
+		return owner
+	}
+
+	return path
+}
+
+// addWatch adds a watch for the regular expression in the watch parameter to
+// the stream, or to every stream of the owner for a listing path. Matches
+// are posted to the webhook parameter's URL, or sent as owner events without
+// one.
+func (s *server) addWatch(res http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+
+	w, err := stream.AddWatch(watchTarget(req.URL.Path), stream.Watch{
+		Pattern: query.Get("watch"),
+		Webhook: query.Get("webhook"),
+	})
+	switch err {
+	case nil:
+	case stream.ErrBadPattern, stream.ErrBadWebhook:
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	default:
+		s.handleError(res, req, err)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusCreated)
+	json.NewEncoder(res).Encode(w)
+}
+
+// listWatches lists the watches of the stream or owner as JSON.
+func (s *server) listWatches(res http.ResponseWriter, req *http.Request) {
+	watches, err := stream.Watches(watchTarget(req.URL.Path))
+	if err != nil {
+		s.handleError(res, req, err)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(struct {
+		Watches []stream.Watch `json:"watches"`
+	}{watches})
+}
+
+// removeWatch removes the watch with the ID in the watch parameter.
+func (s *server) removeWatch(res http.ResponseWriter, req *http.Request) {
+	switch err := stream.RemoveWatch(watchTarget(req.URL.Path), req.URL.Query().Get("watch")); err {
+	case nil:
+		res.WriteHeader(http.StatusNoContent)
+	case stream.ErrNoWatch:
+		http.Error(res, err.Error(), http.StatusNotFound)
+	default:
+		s.handleError(res, req, err)
+	}
+}
+
+// streamEvents sends the owner's stream events as server-sent events, until
+// the client goes away.
+func (s *server) streamEvents(ctx context.Context, res http.ResponseWriter, req *http.Request, owner string) {
+	res.Header().Set("Content-Type", "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.WriteHeader(200)
+	res.(http.Flusher).Flush()
+
+	events := stream.Events(ctx, owner, sseWriter{flushWriter{res.(http.Flusher), res}})
+
+	select {
+	case <-events.Done():
+		if events.Err != nil {
+			s.logger.Printf("%s - ERROR: %s", req.RemoteAddr, events.Err.Error())
+		}
+	case <-res.(http.CloseNotifier).CloseNotify():
+		events.Cancel()
+	}
+}
+
+// followOwner sends the data of the owner's live streams over a single
+// server-sent events connection, limited to the names matching the glob in
+// the follow parameter if it's set.
+func (s *server) followOwner(ctx context.Context, res http.ResponseWriter, req *http.Request, owner string) {
+	pattern := req.URL.Query().Get("follow")
+	if _, err := path.Match(pattern, ""); err != nil {
+		http.Error(res, "Invalid follow pattern", http.StatusBadRequest)
+		return
+	}
+
+	res.Header().Set("Content-Type", "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.WriteHeader(200)
+	res.(http.Flusher).Flush()
+
+	mux := stream.FollowOwner(ctx, owner, pattern, sseWriter{flushWriter{res.(http.Flusher), res}})
+
+	select {
+	case <-mux.Done():
+		if mux.Err != nil {
+			s.logger.Printf("%s - ERROR: %s", req.RemoteAddr, mux.Err.Error())
+		}
+	case <-res.(http.CloseNotifier).CloseNotify():
+		mux.Cancel()
+	}
+}
+
 func (s *server) playbackStream(ctx context.Context, res http.ResponseWriter, req *http.Request) {
-	name := req.URL.Path
+	s.playback(res, req, func(writer io.Writer) *stream.Stream {
+		return stream.Out(ctx, req.URL.Path, writer)
+	})
+}
+
+// playbackGroup plays back the steps of the group at the request path one
+// after the other. Server-sent events playback reports each step's state as
+// it starts and finishes.
+func (s *server) playbackGroup(ctx context.Context, res http.ResponseWriter, req *http.Request) {
+	if exists, err := stream.GroupExists(req.URL.Path); err != nil {
+		s.handleError(res, req, err)
+		return
+	} else if !exists {
+		http.Error(res, stream.ErrNoGroup.Error(), http.StatusNotFound)
+		return
+	}
+
+	s.playback(res, req, func(writer io.Writer) *stream.Stream {
+		return stream.GroupOut(ctx, req.URL.Path, writer)
+	})
+}
+
+func (s *server) playback(res http.ResponseWriter, req *http.Request, play func(io.Writer) *stream.Stream) {
+	var writer io.Writer = res
+
+	res.Header().Add("Vary", "Accept-Encoding")
+	if acceptsGzip(req) {
+		res.Header().Set("Content-Encoding", "gzip")
+
+		gz := gzip.NewWriter(res)
+		defer gz.Close()
+
+		writer = gzipWriter{gz}
+	}
 
-	writer := res.(io.Writer)
-	flusher := res.(http.Flusher)
+	writer = flushWriter{res.(http.Flusher), writer}
 
 	if isSSE(req) {
 		res.Header().Set("Content-Type", "text/event-stream")
-		writer = sseWriter{res}
+		writer = sseWriter{writer}
 	}
 
 	res.WriteHeader(200)
-	out := stream.Out(ctx, name, flushWriter{flusher, writer})
+	out := play(writer)
 
 	select {
 	case <-out.Done():
@@ -196,7 +740,7 @@ func (s *server) upstreamMiddleware(w http.ResponseWriter, r *http.Request, next
 
 	// Hijack is incompatible with use of CloseNotifier
 	var cn <-chan bool
-	if !(r.Method == "POST" || r.Method == "PUT") {
+	if !(r.Method == "POST" || r.Method == "PUT" || r.Method == "PATCH") {
 		cn = w.(http.CloseNotifier).CloseNotify()
 	} else {
 		cn = make(chan bool)
@@ -26,3 +26,13 @@ func (w sseWriter) Write(buf []byte) (int, error) {
 		return w.w.Write([]byte(message))
 	}
 }
+
+func (w sseWriter) WriteEvent(event string, data interface{}) error {
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.w.Write([]byte("event:" + event + "\ndata:" + string(buf) + "\n\n"))
+	return err
+}
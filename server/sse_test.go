@@ -1,8 +1,11 @@
 package server
 
 import (
+	"bytes"
 	"io"
 	"testing"
+
+	"github.com/htee/hteed/stream"
 )
 
 func TestSSEData(t *testing.T) {
@@ -26,3 +29,17 @@ func TestSSEData(t *testing.T) {
 	assertEqual("data:abc\n", "data:\"data:abc\\n\"\n\n")
 	assertEqual("☃", "data:\"☃\"\n\n")
 }
+
+func TestSSEEvent(t *testing.T) {
+	var buf bytes.Buffer
+	sw := sseWriter{&buf}
+
+	if err := sw.WriteEvent("gap", stream.Gap{Offset: 10, Length: 20}); err != nil {
+		t.Error(err)
+	}
+
+	want := "event:gap\ndata:{\"offset\":10,\"length\":20}\n\n"
+	if buf.String() != want {
+		t.Errorf("SSE formatted event is %q, want %q", buf.String(), want)
+	}
+}
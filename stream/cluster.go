@@ -0,0 +1,282 @@
+package stream
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/htee/hteed/Godeps/_workspace/src/github.com/garyburd/redigo/redis"
+	"github.com/htee/hteed/config"
+)
+
+const clusterSlots = 16384
+
+// hashTags is set when running against a cluster. Key names then carry the
+// stream name as a hash tag, so that every key of a stream lands in the same
+// slot and can be used in one transaction.
+var hashTags bool
+
+// A cluster routes each stream to the node serving its slot. The slot map is
+// read from the seed node and refreshed whenever a command is redirected or
+// a node can't be reached. The redirected command itself still fails.
+type cluster struct {
+	dialer *dialer
+	cnf    *config.Config
+
+	mu         sync.Mutex
+	slots      []string // node address by slot
+	pools      map[string]*pool
+	seeds      []string
+	refreshing bool
+}
+
+func newCluster(d *dialer, cnf *config.Config) (*cluster, error) {
+	if d.db != 0 {
+		return nil, errors.New("Redis cluster only supports database 0")
+	}
+
+	c := &cluster{
+		dialer: d,
+		cnf:    cnf,
+		pools:  make(map[string]*pool),
+		seeds:  []string{d.address},
+	}
+
+	return c, c.refresh()
+}
+
+// refresh reads the slot map from the first known node that answers.
+func (c *cluster) refresh() error {
+	err := errors.New("No redis cluster nodes reachable")
+
+	for _, addr := range c.nodes() {
+		var slots []string
+		if slots, err = c.readSlots(addr); err == nil {
+			c.mu.Lock()
+			c.slots = slots
+			c.mu.Unlock()
+
+			return nil
+		}
+	}
+
+	return err
+}
+
+// nodes returns the address of every known node, seeds first.
+func (c *cluster) nodes() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	addrs := append([]string(nil), c.seeds...)
+	for addr := range c.pools {
+		if addr != c.seeds[0] {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	return addrs
+}
+
+func (c *cluster) readSlots(addr string) ([]string, error) {
+	conn, err := c.dialer.at(addr).dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	ranges, err := redis.Values(conn.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return nil, err
+	}
+
+	seedHost, _, _ := net.SplitHostPort(addr)
+
+	slots := make([]string, clusterSlots)
+	for _, r := range ranges {
+		var start, end int
+		var primary []interface{}
+
+		fields, err := redis.Values(r, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := redis.Scan(fields, &start, &end, &primary); err != nil {
+			return nil, err
+		}
+
+		var host string
+		var port int
+		if _, err := redis.Scan(primary, &host, &port); err != nil {
+			return nil, err
+		}
+
+		if host == "" {
+			host = seedHost
+		}
+
+		node := net.JoinHostPort(host, strconv.Itoa(port))
+		for slot := start; slot <= end && slot < clusterSlots; slot++ {
+			slots[slot] = node
+		}
+	}
+
+	return slots, nil
+}
+
+// refreshLater refreshes the slot map in the background, unless a refresh is
+// already running.
+func (c *cluster) refreshLater() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.refreshing {
+		return
+	}
+	c.refreshing = true
+
+	go func() {
+		c.refresh()
+
+		c.mu.Lock()
+		c.refreshing = false
+		c.mu.Unlock()
+	}()
+}
+
+func (c *cluster) pool(addr string) *pool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p, ok := c.pools[addr]
+	if !ok {
+		p = newPool(c.dialer.at(addr).dial, c.cnf)
+		c.pools[addr] = p
+	}
+
+	return p
+}
+
+func (c *cluster) get(name string) redis.Conn {
+	return c.conn((&Stream{Name: name}).stateKey())
+}
+
+func (c *cluster) conn(key string) redis.Conn {
+	return clusterConn{c.pool(c.node(key)).Get(), c}
+}
+
+func (c *cluster) with(held redis.Conn, key string) redis.Conn {
+	if cc, ok := held.(clusterConn); ok {
+		held = cc.Conn
+	}
+
+	return clusterConn{c.pool(c.node(key)).with(held), c}
+}
+
+// node returns the address of the node serving key's slot.
+func (c *cluster) node(key string) string {
+	c.mu.Lock()
+	addr := c.slots[keySlot(key)]
+	c.mu.Unlock()
+
+	if addr == "" {
+		addr = c.seeds[0]
+	}
+
+	return addr
+}
+
+func (c *cluster) primaries() []redis.Conn {
+	c.mu.Lock()
+	addrs := make(map[string]bool)
+	for _, addr := range c.slots {
+		if addr != "" {
+			addrs[addr] = true
+		}
+	}
+	c.mu.Unlock()
+
+	var conns []redis.Conn
+	for addr := range addrs {
+		conns = append(conns, clusterConn{c.pool(addr).Get(), c})
+	}
+
+	return conns
+}
+
+// dialSubscriber opens a subscriber connection to the first node that
+// answers. Messages published on any node reach every node.
+func (c *cluster) dialSubscriber() (redis.Conn, error) {
+	err := errors.New("No redis cluster nodes reachable")
+
+	for _, addr := range c.nodes() {
+		var conn redis.Conn
+		if conn, err = c.dialer.at(addr).dialSubscriber(); err == nil {
+			return conn, nil
+		}
+	}
+
+	return nil, err
+}
+
+// A clusterConn refreshes the cluster's slot map when one of its commands is
+// redirected or its node fails.
+type clusterConn struct {
+	redis.Conn
+	cluster *cluster
+}
+
+func (c clusterConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	reply, err := c.Conn.Do(cmd, args...)
+
+	if err != nil && (redirected(err) || c.Conn.Err() != nil) {
+		c.cluster.refreshLater()
+	}
+
+	return reply, err
+}
+
+func redirected(err error) bool {
+	if err, ok := err.(redis.Error); ok {
+		msg := string(err)
+		return strings.HasPrefix(msg, "MOVED ") ||
+			strings.HasPrefix(msg, "ASK ") ||
+			strings.HasPrefix(msg, "CLUSTERDOWN ")
+	}
+
+	return false
+}
+
+// keySlot returns the cluster slot of a key, hashing only its hash tag if it
+// has one.
+func keySlot(key string) int {
+	if i := strings.IndexByte(key, '{'); i >= 0 {
+		if j := strings.IndexByte(key[i+1:], '}'); j > 0 {
+			key = key[i+1 : i+1+j]
+		}
+	}
+
+	return int(crc16(key) % clusterSlots)
+}
+
+// crc16 is the CRC-16/XMODEM checksum used for cluster slots.
+func crc16(s string) uint16 {
+	var crc uint16
+
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+
+		for b := 0; b < 8; b++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+
+	return crc
+}
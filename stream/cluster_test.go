@@ -0,0 +1,29 @@
+package stream
+
+import "testing"
+
+func TestKeySlot(t *testing.T) {
+	for key, want := range map[string]int{
+		"123456789":            0x31c3,
+		"foo":                  12182,
+		"{user1000}.following": keySlot("user1000"),
+		"foo{}{bar}":           keySlot("foo{}{bar}"),
+		"foo{{bar}}zap":        keySlot("{bar"),
+	} {
+		if got := keySlot(key); got != want {
+			t.Errorf("slot of %q is %d, want %d", key, got, want)
+		}
+	}
+
+	defer func(h bool) { hashTags = h }(hashTags)
+	hashTags = true
+
+	s := &Stream{Name: "/user/stream"}
+	slot := keySlot(s.stateKey())
+
+	for _, key := range []string{s.dataKey(), s.streamKey(), s.manifestKey(), s.segmentKey(2), s.compressedKey(2)} {
+		if keySlot(key) != slot {
+			t.Errorf("%s isn't in the same slot as %s", key, s.stateKey())
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package stream
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"github.com/htee/hteed/Godeps/_workspace/src/code.google.com/p/go.net/context"
+	"github.com/htee/hteed/Godeps/_workspace/src/github.com/garyburd/redigo/redis"
+)
+
+var (
+	ErrNoStream     = errors.New("Stream does not exist")
+	ErrStreamExists = errors.New("Stream already exists")
+	ErrForeignCopy  = errors.New("Cannot copy another owner's stream")
+)
+
+// Copy copies the stream src to the new stream dst, up to end bytes or all
+// of it if end is negative. The copy finishes in the same state as the
+// source, or closed if the source is still being recorded or was truncated.
+// The source's markers within the copied data are copied too, unless the
+// copy follows the source, and so is its metadata, such as when it was
+// created.
+// With follow set, the copy instead keeps following a source that is still
+// being recorded, until it finishes or reaches end.
+//
+// The upstream only authorizes the request for dst, so src must have the
+// same owner.
+//
+// The copy runs in the background, holding the writer's lease on dst, and
+// is done once the returned stream's Done channel is closed.
+func Copy(ctx context.Context, src, dst string, end int64, follow bool) (*Stream, error) {
+	if owner(src) != owner(dst) {
+		return nil, ErrForeignCopy
+	}
+
+	s, err := acquireStream(ctx, dst)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Stream{
+		Name: src,
+		done: make(chan struct{}),
+	}
+	r.conn = s.connTo(shards.shard(src), r.stateKey())
+
+	if err := s.prepareCopy(r); err != nil {
+		r.conn.Close()
+		s.drop()
+		return nil, err
+	}
+
+	if follow {
+		r.conn.Close()
+		r.conn = nil
+		r.viewer = shards.shard(src).hub.join(src)
+	}
+
+	go copyIn(s, r, end)
+
+	return s, nil
+}
+
+// prepareCopy checks that the source exists and the copy doesn't.
+func (s *Stream) prepareCopy(r *Stream) error {
+	if exists, err := redis.Bool(r.conn.Do("EXISTS", r.stateKey())); err != nil {
+		return err
+	} else if !exists {
+		return ErrNoStream
+	}
+
+	if exists, err := redis.Bool(s.conn.Do("EXISTS", s.stateKey())); err != nil {
+		return err
+	} else if exists {
+		return ErrStreamExists
+	}
+
+	return nil
+}
+
+func copyIn(s *Stream, r *Stream, end int64) {
+	defer s.close()
+	defer r.close()
+
+	var err error
+	if r.viewer != nil {
+		err = s.follow(r, end)
+	} else {
+		err = s.copySnapshot(r, end)
+	}
+
+	if err == nil {
+		err = s.flush()
+	}
+
+	if err == nil {
+		err = s.copyMeta(r)
+	}
+
+	if err != nil {
+		s.Err = err
+		return
+	}
+
+	if err := s.finish(); err != nil {
+		s.Err = err
+	}
+}
+
+// copySnapshot copies the source's data as it is now.
+func (s *Stream) copySnapshot(r *Stream, end int64) error {
+	state, size, err := r.snapshot()
+	if err != nil {
+		return err
+	}
+
+	if end >= 0 && end < size {
+		size, state = end, Closed
+	} else if state == Opened {
+		state = Closed
+	}
+
+	// The source's markers are stored along with the first of the copied
+	// data.
+	markers, err := r.markers()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range markers {
+		if m.Offset <= size {
+			s.marks = append(s.marks, m)
+		}
+	}
+
+	for offset := int64(0); offset < size; {
+		next := offset + int64(snapshotPage)
+		if snapshotPage <= 0 || next > size {
+			next = size
+		}
+
+		buf, err := r.readRange(offset, next)
+		if err != nil {
+			return err
+		} else if int64(len(buf)) < next-offset {
+			return ErrNoStream
+		}
+
+		s.batch = append(s.batch, buf...)
+		if err := s.flush(); err != nil {
+			return err
+		}
+
+		offset = next
+	}
+
+	s.final = state
+
+	return nil
+}
+
+// follow copies the source's data as a viewer, until the source finishes or
+// the copy reaches end. Data the viewer skips fails the copy.
+func (s *Stream) follow(r *Stream, end int64) error {
+	var renew <-chan time.Time
+	if leaseTTL > 0 {
+		ticker := time.NewTicker(leaseTTL / 3)
+		defer ticker.Stop()
+
+		renew = ticker.C
+	}
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		case <-renew:
+			if err := s.renew(); err == ErrLeaseLost {
+				return err
+			}
+		case <-r.viewer.ready:
+			for _, v := range r.viewer.take() {
+				if v.err == io.EOF {
+					return s.finishedWith(r)
+				} else if v.err != nil {
+					return v.err
+				}
+
+				buf := v.buf
+				if end >= 0 && s.size+int64(len(s.batch)+len(buf)) >= end {
+					buf = buf[:end-s.size-int64(len(s.batch))]
+					s.batch = append(s.batch, buf...)
+
+					return nil
+				}
+
+				s.batch = append(s.batch, buf...)
+				if err := s.flush(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// copyMeta copies the source's metadata over the copy's. The copy's finish
+// time is set when it finishes.
+func (s *Stream) copyMeta(r *Stream) error {
+	conn := s.connTo(shards.shard(r.Name), r.stateKey())
+	defer conn.Close()
+
+	fields, err := redis.Values(conn.Do("HGETALL", r.metaKey()))
+	if err != nil || len(fields) == 0 {
+		return err
+	}
+
+	_, err = s.conn.Do("HMSET", append([]interface{}{s.metaKey()}, fields...)...)
+
+	return err
+}
+
+// finishedWith sets the copy to finish in the state the source finished in.
+func (s *Stream) finishedWith(r *Stream) error {
+	conn := s.connTo(shards.shard(r.Name), r.stateKey())
+	defer conn.Close()
+
+	state, err := (&Stream{Name: r.Name, conn: conn}).getState()
+	if err == redis.ErrNil {
+		// The source was deleted.
+		return ErrNoStream
+	} else if err != nil {
+		return err
+	}
+
+	if state != Opened {
+		s.final = state
+	}
+
+	return nil
+}
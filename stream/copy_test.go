@@ -0,0 +1,98 @@
+package stream
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/htee/hteed/Godeps/_workspace/src/code.google.com/p/go.net/context"
+)
+
+func TestCopy(t *testing.T) {
+	defer func(ttl time.Duration, r *ring) { leaseTTL, shards = ttl, r }(leaseTTL, shards)
+	leaseTTL = time.Minute
+
+	conn := newMemConn()
+	shards = newRing(memShard("mem:6379", conn))
+
+	src, err := Open(context.Background(), "/test/source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src.Record(strings.NewReader("hello world"))
+	<-src.Done()
+
+	aborted := &Stream{Name: "/test/aborted", conn: conn}
+	if err := aborted.append([]byte("oops")); err != nil {
+		t.Fatal(err)
+	}
+	conn.strings[aborted.stateKey()] = []byte("2")
+
+	copyTo := func(src, dst string, end int64) error {
+		cp, err := Copy(context.Background(), src, dst, end, false)
+		if err != nil {
+			return err
+		}
+
+		<-cp.Done()
+
+		return cp.Err
+	}
+
+	check := func(name string, wantState State, want string) {
+		r := &Stream{Name: name, conn: conn}
+
+		state, size, err := r.snapshot()
+		if err != nil {
+			t.Fatal(err)
+		} else if state != wantState || size != int64(len(want)) {
+			t.Errorf("%s is %d bytes in state %d, want %d bytes in state %d", name, size, state, len(want), wantState)
+		}
+
+		if buf, err := r.readRange(0, size); err != nil || string(buf) != want {
+			t.Errorf("%s reads %q, %v, want %q", name, buf, err, want)
+		}
+
+		if _, ok := conn.strings[r.leaseKey()]; ok {
+			t.Errorf("%s kept its lease", name)
+		}
+	}
+
+	// The copy is created when its source was.
+	conn.hashes[src.metaKey()]["created"] = []byte("1000")
+
+	if err := copyTo("/test/source", "/test/copy", -1); err != nil {
+		t.Fatal(err)
+	}
+	check("/test/copy", Closed, "hello world")
+
+	if created := string(conn.hashes[(&Stream{Name: "/test/copy"}).metaKey()]["created"]); created != "1000" {
+		t.Errorf("copy was created at %s, want 1000", created)
+	}
+
+	if err := copyTo("/test/source", "/test/truncated", 5); err != nil {
+		t.Fatal(err)
+	}
+	check("/test/truncated", Closed, "hello")
+
+	if err := copyTo("/test/aborted", "/test/aborted-copy", -1); err != nil {
+		t.Fatal(err)
+	}
+	check("/test/aborted-copy", Aborted, "oops")
+
+	if err := copyTo("/test/source", "/test/copy", -1); err != ErrStreamExists {
+		t.Errorf("copied over an existing stream with %v, want ErrStreamExists", err)
+	}
+
+	if err := copyTo("/test/missing", "/test/nothing", -1); err != ErrNoStream {
+		t.Errorf("copied a missing stream with %v, want ErrNoStream", err)
+	}
+
+	if err := copyTo("/test/source", "/other/copy", -1); err != ErrForeignCopy {
+		t.Errorf("copied another owner's stream with %v, want ErrForeignCopy", err)
+	}
+
+	if _, ok := conn.strings[(&Stream{Name: "/test/nothing"}).leaseKey()]; ok {
+		t.Error("failed copy kept its lease")
+	}
+}
@@ -0,0 +1,130 @@
+package stream
+
+import (
+	"encoding/json"
+
+	"github.com/htee/hteed/Godeps/_workspace/src/code.google.com/p/go.net/context"
+)
+
+// An Event is published on an owner's events channel whenever one of their
+// streams is opened, reopened, finished or deleted, or raises an alert
+// without a webhook. The channel lives on the same shard as the owner's
+// index.
+type Event struct {
+	Type  string `json:"type"` // opened, reopened, closed, aborted, deleted or alert
+	Name  string `json:"name"`
+	Size  int64  `json:"size"` // the offset it was reopened at, for reopened
+	Alert *Alert `json:"alert,omitempty"`
+}
+
+func eventsKey(owner string) string { return keyPrefix + "events:" + owner }
+
+// opened indexes the stream created at the time in milliseconds, and
+// announces it.
+func (s *Stream) opened(at int64) error {
+	if err := s.list("ZADD", at, s.Name); err != nil {
+		return err
+	}
+
+	return s.announce("opened")
+}
+
+// announceOpened indexes and announces the stream once the append that
+// created it is stored, or announces it as reopened once the first append
+// after it ended is. A failure is logged rather than failing the append,
+// which mustn't be run again for it, and the stream is announced on the next
+// append or when it's finished instead.
+func (s *Stream) announceOpened() {
+	var err error
+	switch {
+	case s.created != 0:
+		if err = s.opened(s.created); err == nil {
+			s.created = 0
+		}
+	case s.reopened != 0:
+		e := Event{Type: "reopened", Name: s.Name, Size: s.reopened}
+		if err = s.publish(e); err == nil {
+			queueWebhook(e)
+			s.reopened = 0
+		}
+	}
+
+	if err != nil {
+		logger.Printf("Announcing %s failed: %s", s.Name, err)
+	}
+}
+
+// announce publishes the event on the stream owner's events channel, and
+// queues it as a webhook for the upstream.
+func (s *Stream) announce(event string) error {
+	e := Event{Type: event, Name: s.Name, Size: s.size}
+	queueWebhook(e)
+
+	return s.publish(e)
+}
+
+func (s *Stream) publish(event Event) error {
+	o := owner(s.Name)
+	if o == "" || shards == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	key := ownerKey(o)
+	conn := s.connTo(shards.shard(key), key)
+	defer conn.Close()
+
+	_, err = conn.Do("PUBLISH", eventsKey(o), data)
+
+	return err
+}
+
+// Events writes the events of the owner's streams to the writer as they're
+// published, until the context is done.
+func Events(ctx context.Context, owner string, writer EventWriter) *Stream {
+	s := &Stream{
+		ctx:  ctx,
+		Name: owner,
+		done: make(chan struct{}),
+	}
+	s.viewer = shards.shard(ownerKey(owner)).hub.listen(eventsKey(owner))
+
+	go streamEvents(s, writer)
+
+	return s
+}
+
+func streamEvents(s *Stream, writer EventWriter) {
+	defer s.close()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-s.done:
+			return
+		case <-s.viewer.ready:
+			for _, v := range s.viewer.take() {
+				if v.err != nil {
+					s.Err = v.err
+					return
+				}
+
+				var event Event
+				if err := json.Unmarshal(v.buf, &event); err != nil {
+					s.Err = err
+					return
+				}
+
+				if err := writer.WriteEvent(event.Type, event); err != nil {
+					s.Err = err
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package stream
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/htee/hteed/Godeps/_workspace/src/code.google.com/p/go.net/context"
+	"github.com/htee/hteed/Godeps/_workspace/src/github.com/garyburd/redigo/redis"
+)
+
+func TestAnnounceLifecycle(t *testing.T) {
+	defer func(r *ring) { shards = r }(shards)
+
+	conn := newMemConn()
+	shards = newRing(memShard("mem:6379", conn))
+
+	s := &Stream{Name: "/alice/build", conn: conn}
+	if err := s.append([]byte("hello")); err != nil {
+		t.Fatal(err)
+	} else if err := s.append([]byte(" world")); err != nil {
+		t.Fatal(err)
+	} else if err := s.finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &Stream{Name: s.Name, conn: conn}
+	if err := r.reopen(); err != nil {
+		t.Fatal(err)
+	} else if err := r.append([]byte("!")); err != nil {
+		t.Fatal(err)
+	} else if err := r.finish(); err != nil {
+		t.Fatal(err)
+	} else if err := StreamDelete(context.Background(), s.Name); err != nil {
+		t.Fatal(err)
+	}
+
+	var events []Event
+	for _, data := range conn.messages[eventsKey("alice")] {
+		var event Event
+		if err := json.Unmarshal(data, &event); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+
+	want := []Event{
+		{Type: "opened", Name: s.Name, Size: 5},
+		{Type: "closed", Name: s.Name, Size: 11},
+		{Type: "reopened", Name: s.Name, Size: 11},
+		{Type: "closed", Name: s.Name, Size: 12},
+		{Type: "deleted", Name: s.Name, Size: 0},
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("announced %v, want %v", events, want)
+	}
+}
+
+func TestHubFeed(t *testing.T) {
+	rConn, nConn := redisPipeConn()
+	h := newHub(func() (redis.Conn, error) { return rConn, nil }, nil)
+
+	channel := eventsKey("alice")
+	v := h.listen(channel)
+
+	buf := make([]byte, 64)
+	if _, err := nConn.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		nConn.Write([]byte(respSubscribed(channel)))
+		for _, data := range []string{"one", "two"} {
+			nConn.Write([]byte(fmt.Sprintf("*3\r\n$7\r\nmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n",
+				len(channel), channel, len(data), data)))
+		}
+	}()
+
+	var got []string
+	for len(got) < 2 {
+		select {
+		case <-v.ready:
+			for _, be := range v.take() {
+				if be.err != nil {
+					t.Fatal(be.err)
+				}
+				got = append(got, string(be.buf))
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out after %v", got)
+		}
+	}
+
+	if !reflect.DeepEqual(got, []string{"one", "two"}) {
+		t.Errorf("feed received %v, want [one two]", got)
+	}
+
+	v.leave()
+}
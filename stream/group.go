@@ -0,0 +1,278 @@
+package stream
+
+import (
+	"errors"
+	"io"
+
+	"github.com/htee/hteed/Godeps/_workspace/src/code.google.com/p/go.net/context"
+	"github.com/htee/hteed/Godeps/_workspace/src/github.com/garyburd/redigo/redis"
+)
+
+var (
+	ErrNoGroup     = errors.New("Group does not exist")
+	ErrGroupExists = errors.New("Group already exists")
+	ErrGroupClosed = errors.New("Group is closed")
+)
+
+// A group is an ordered list of streams, its steps, such as the steps of one
+// pipeline run. Steps are added by the recorders of the streams until the
+// group is closed. The group is kept in a hash holding its state, and a list
+// of its steps, under the group name's hash tag. Changes are published on
+// the group's own channel for its viewers.
+
+// A Step describes a group's step in its playback.
+type Step struct {
+	Index int    `json:"index"`
+	Name  string `json:"name"`
+	State State  `json:"state"`
+}
+
+func groupKey(name string) string { return (&Stream{Name: name}).key("group:") }
+
+func stepsKey(name string) string { return (&Stream{Name: name}).key("group:steps:") }
+
+func groupChannel(name string) string { return (&Stream{Name: name}).key("group:events:") }
+
+func groupConn(name string) redis.Conn { return shards.shard(name).servers.get(name) }
+
+// CreateGroup creates an open group.
+func CreateGroup(name string) error {
+	conn := groupConn(name)
+	defer conn.Close()
+
+	created, err := redis.Bool(conn.Do("HSETNX", groupKey(name), "state", Opened))
+	if err != nil {
+		return err
+	} else if !created {
+		return ErrGroupExists
+	}
+
+	return nil
+}
+
+// CloseGroup closes the group, once its last step has been added.
+func CloseGroup(name string) error {
+	conn := groupConn(name)
+	defer conn.Close()
+
+	return changeGroup(conn, name, func(conn redis.Conn) {
+		conn.Send("HSET", groupKey(name), "state", Closed)
+	})
+}
+
+// OpenStep opens the stream like Open, and adds it to the open group as its
+// next step.
+func OpenStep(ctx context.Context, name, group string) (*Stream, error) {
+	conn := groupConn(group)
+	err := checkGroup(conn, group)
+	conn.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := Open(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// The step is marked as opened before any data is recorded, so that the
+	// group's viewers wait for its data rather than skip it. If it can't be
+	// added to the group after all, its state is put back, so that it isn't
+	// left open without a writer.
+	prev, err := s.conn.Do("GETSET", s.stateKey(), Opened)
+	if err != nil {
+		s.drop()
+		return nil, err
+	}
+
+	conn = s.connTo(shards.shard(group), groupKey(group))
+	err = changeGroup(conn, group, func(conn redis.Conn) {
+		conn.Send("RPUSH", stepsKey(group), name)
+	})
+	conn.Close()
+
+	if err != nil {
+		if prev == nil {
+			s.conn.Do("DEL", s.stateKey())
+		} else {
+			s.conn.Do("SET", s.stateKey(), prev)
+		}
+
+		s.drop()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// checkGroup returns ErrNoGroup or ErrGroupClosed unless the group is open.
+func checkGroup(conn redis.Conn, name string) error {
+	if state, err := redis.Int(conn.Do("HGET", groupKey(name), "state")); err == redis.ErrNil {
+		return ErrNoGroup
+	} else if err != nil {
+		return err
+	} else if State(state) != Opened {
+		return ErrGroupClosed
+	}
+
+	return nil
+}
+
+// changeGroup queues the change to the open group in a transaction, and
+// tells its viewers.
+func changeGroup(conn redis.Conn, name string, change func(redis.Conn)) error {
+	conn.Send("WATCH", groupKey(name))
+
+	if err := checkGroup(conn, name); err != nil {
+		conn.Do("UNWATCH")
+		return err
+	}
+
+	conn.Send("MULTI")
+	change(conn)
+	conn.Send("PUBLISH", groupChannel(name), "changed")
+	if reply, err := conn.Do("EXEC"); err != nil {
+		return err
+	} else if reply == nil {
+		// The group was closed meanwhile.
+		return ErrGroupClosed
+	}
+
+	return nil
+}
+
+// readGroup returns the group's state, and its steps from the one at index
+// from on.
+func readGroup(conn redis.Conn, name string, from int) (State, []string, error) {
+	conn.Send("MULTI")
+	conn.Send("HGET", groupKey(name), "state")
+	conn.Send("LRANGE", stepsKey(name), from, -1)
+
+	reply, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return 0, nil, err
+	} else if reply[0] == nil {
+		return 0, nil, ErrNoGroup
+	}
+
+	var state State
+	var steps []string
+	if _, err := redis.Scan(reply, &state, &steps); err != nil {
+		return 0, nil, err
+	}
+
+	return state, steps, nil
+}
+
+// GroupExists reports whether the group exists.
+func GroupExists(name string) (bool, error) {
+	conn := groupConn(name)
+	defer conn.Close()
+
+	return redis.Bool(conn.Do("EXISTS", groupKey(name)))
+}
+
+// GroupOut plays the group's steps back one after the other, following the
+// running one, until the group is closed and its last step finished. When the
+// writer is an EventWriter, each step is reported by a "step" event as it
+// starts and once it finishes.
+func GroupOut(ctx context.Context, name string, writer io.Writer) *Stream {
+	s := &Stream{
+		ctx:  ctx,
+		Name: name,
+		done: make(chan struct{}),
+	}
+
+	// The group's changes are listened to before it's read, so that none are
+	// missed.
+	s.viewer = shards.shard(name).hub.listen(groupChannel(name))
+
+	go groupOut(s, writer)
+
+	return s
+}
+
+func groupOut(s *Stream, writer io.Writer) {
+	defer s.close()
+
+	for i := 0; ; {
+		// The connection isn't held while the steps are played, since they
+		// need their own.
+		conn := groupConn(s.Name)
+		state, steps, err := readGroup(conn, s.Name, i)
+		conn.Close()
+
+		if err != nil {
+			s.Err = err
+			return
+		}
+
+		for _, step := range steps {
+			if err := s.playStep(writer, i, step); err != nil {
+				if s.ctx.Err() == nil {
+					s.Err = err
+				}
+				return
+			}
+			i++
+		}
+
+		if len(steps) > 0 {
+			continue
+		} else if state != Opened {
+			return
+		}
+
+		// Wait for the group to change.
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-s.done:
+			return
+		case <-s.viewer.ready:
+			for _, v := range s.viewer.take() {
+				if v.err != nil {
+					s.Err = v.err
+					return
+				}
+			}
+		}
+	}
+}
+
+// playStep plays back the group's step at index i to its end.
+func (s *Stream) playStep(writer io.Writer, i int, name string) error {
+	if err := reportStep(writer, i, name); err != nil {
+		return err
+	}
+
+	out := outStream(s.ctx, name, writer)
+
+	streamOut(out, writer)
+
+	if out.Err != nil {
+		return out.Err
+	} else if err := s.ctx.Err(); err != nil {
+		return err
+	}
+
+	return reportStep(writer, i, name)
+}
+
+func reportStep(writer io.Writer, i int, name string) error {
+	ew, ok := writer.(EventWriter)
+	if !ok {
+		return nil
+	}
+
+	conn := shards.shard(name).servers.get(name)
+	defer conn.Close()
+
+	state, err := (&Stream{Name: name, conn: conn}).getState()
+	if err != nil && err != redis.ErrNil {
+		return err
+	}
+
+	return ew.WriteEvent("step", Step{i, name, state})
+}
@@ -0,0 +1,96 @@
+package stream
+
+import (
+	"testing"
+	"time"
+
+	"github.com/htee/hteed/Godeps/_workspace/src/code.google.com/p/go.net/context"
+	"github.com/htee/hteed/Godeps/_workspace/src/github.com/garyburd/redigo/redis"
+)
+
+func TestGroup(t *testing.T) {
+	defer func(ttl time.Duration, r *ring) { leaseTTL, shards = ttl, r }(leaseTTL, shards)
+	leaseTTL = time.Minute
+
+	conn := newMemConn()
+	rConn, nConn := redisPipeConn()
+
+	p := &redis.Pool{Dial: func() (redis.Conn, error) { return conn, nil }}
+	shards = newRing(newShard("mem:6379", server{p}, func() (redis.Conn, error) { return rConn, nil }))
+
+	go confirmSubscriptions(nConn)
+
+	group := "/alice/run-1"
+
+	if _, err := OpenStep(context.Background(), "/alice/orphan", group); err != ErrNoGroup {
+		t.Errorf("added a step to a missing group with %v, want ErrNoGroup", err)
+	}
+	if _, ok := conn.strings[(&Stream{Name: "/alice/orphan"}).stateKey()]; ok {
+		t.Error("step of a missing group was left open")
+	}
+
+	if err := CreateGroup(group); err != nil {
+		t.Fatal(err)
+	} else if err := CreateGroup(group); err != ErrGroupExists {
+		t.Errorf("created the group twice with %v, want ErrGroupExists", err)
+	}
+
+	first, err := OpenStep(context.Background(), "/alice/build", group)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := first.append([]byte("one")); err != nil {
+		t.Fatal(err)
+	} else if err := first.finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := OpenStep(context.Background(), "/alice/test", group)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(eventRecorder, 16)
+	out := GroupOut(context.Background(), group, events)
+	defer out.Cancel()
+
+	events.expect(t, "step", Step{0, "/alice/build", Closed})
+	events.expect(t, "write", "one")
+	events.expect(t, "step", Step{0, "/alice/build", Closed})
+
+	// The running step is followed from its start, before it has any data.
+	events.expect(t, "step", Step{1, "/alice/test", Opened})
+
+	if err := second.append([]byte("two")); err != nil {
+		t.Fatal(err)
+	} else if err := second.finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	channel := second.streamKey()
+	writeFeed(nConn, channel, message{Opened, 0, []byte("two")}.encode())
+	writeFeed(nConn, channel, message{Closed, 3, nil}.encode())
+
+	events.expect(t, "write", "two")
+	events.expect(t, "step", Step{1, "/alice/test", Closed})
+
+	if err := CloseGroup(group); err != nil {
+		t.Fatal(err)
+	}
+	writeFeed(nConn, groupChannel(group), []byte("changed"))
+
+	select {
+	case <-out.Done():
+		if out.Err != nil {
+			t.Error(out.Err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("group playback didn't end once the group was closed")
+	}
+
+	if _, err := OpenStep(context.Background(), "/alice/late", group); err != ErrGroupClosed {
+		t.Errorf("added a step to a closed group with %v, want ErrGroupClosed", err)
+	}
+	if _, ok := conn.strings[(&Stream{Name: "/alice/late"}).stateKey()]; ok {
+		t.Error("step of a closed group was left open")
+	}
+}
@@ -0,0 +1,226 @@
+package stream
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/htee/hteed/config"
+)
+
+var (
+	webhookURL   string // empty disables webhooks
+	webhookToken string
+	webhookDir   string
+	webhookWake  = make(chan struct{}, 1)
+
+	webhooksQueued = expvar.NewInt("webhooks_queued")
+	webhooksSent   = expvar.NewInt("webhooks_sent")
+	webhooksFailed = expvar.NewInt("webhooks_failed")
+)
+
+const (
+	webhookRetryDelay    = time.Second
+	maxWebhookRetryDelay = time.Minute
+	maxWebhookAge        = 24 * time.Hour
+)
+
+// A webhook tells the upstream web app about a stream being opened, closed,
+// aborted or deleted. Webhooks are queued as files in the webhook directory,
+// so that they survive a restart, and posted in order by a single worker,
+// which retries with a growing delay while the upstream can't be reached.
+// Webhooks the upstream rejects, or that are older than maxWebhookAge, are
+// dropped.
+//
+// Each webhook is signed with the web token: its X-Htee-Signature header
+// holds the hex HMAC-SHA256 of the X-Htee-Timestamp header, a dot and the
+// body.
+type webhook struct {
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+	Event
+}
+
+func configureWebhooks(cnf *config.Config) error {
+	base, err := url.Parse(cnf.WebURL)
+	if err != nil {
+		return err
+	}
+
+	ref, err := url.Parse(cnf.WebhookPath)
+	if err != nil {
+		return err
+	}
+
+	u := base.ResolveReference(ref)
+	if !u.IsAbs() || u.Host == "" {
+		return fmt.Errorf("Webhook URL %q isn't absolute, set web-url", u)
+	}
+
+	// The queue is only this instance's, so it isn't given a shared default.
+	if cnf.WebhookDir == "" {
+		return errors.New("Webhooks require a webhook-dir")
+	}
+
+	webhookURL = u.String()
+	webhookToken = cnf.WebToken
+	webhookDir = cnf.WebhookDir
+
+	if err := os.MkdirAll(webhookDir, 0700); err != nil {
+		return err
+	}
+
+	paths, _ := filepath.Glob(filepath.Join(webhookDir, "*.json"))
+	webhooksQueued.Set(int64(len(paths)))
+
+	go deliverWebhooks()
+
+	return nil
+}
+
+// queueWebhook queues the event for the upstream. Events that can't be
+// queued are counted, but don't fail the change they report.
+func queueWebhook(event Event) {
+	if webhookURL == "" {
+		return
+	}
+
+	h := webhook{ID: newID(), Time: time.Now().UTC(), Event: event}
+
+	data, err := json.Marshal(h)
+	if err != nil {
+		webhooksFailed.Add(1)
+		return
+	}
+
+	// Files are named by time, so that they're delivered in order. They're
+	// written under a temporary name first, so that the worker never reads
+	// one that's only partly written.
+	path := filepath.Join(webhookDir, fmt.Sprintf("%020d-%s.json", h.Time.UnixNano(), h.ID))
+	if err := ioutil.WriteFile(path+".tmp", data, 0600); err != nil {
+		webhooksFailed.Add(1)
+		return
+	} else if err := os.Rename(path+".tmp", path); err != nil {
+		os.Remove(path + ".tmp")
+		webhooksFailed.Add(1)
+		return
+	}
+
+	webhooksQueued.Add(1)
+
+	select {
+	case webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+func deliverWebhooks() {
+	delay := webhookRetryDelay
+
+	for {
+		var retry <-chan time.Time
+		if deliverQueued() {
+			delay = webhookRetryDelay
+		} else {
+			retry = time.After(delay)
+			if delay *= 2; delay > maxWebhookRetryDelay {
+				delay = maxWebhookRetryDelay
+			}
+		}
+
+		select {
+		case <-webhookWake:
+		case <-retry:
+		}
+	}
+}
+
+// deliverQueued posts the queued webhooks in order. It reports false if one
+// of them has to be tried again later.
+func deliverQueued() bool {
+	paths, _ := filepath.Glob(filepath.Join(webhookDir, "*.json"))
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		var h webhook
+		if err := json.Unmarshal(data, &h); err != nil || time.Since(h.Time) > maxWebhookAge {
+			dropWebhook(path, webhooksFailed)
+			continue
+		}
+
+		if retry, err := postWebhook(h, data); err == nil {
+			dropWebhook(path, webhooksSent)
+		} else if retry {
+			return false
+		} else {
+			dropWebhook(path, webhooksFailed)
+		}
+	}
+
+	return true
+}
+
+func dropWebhook(path string, counter *expvar.Int) {
+	if err := os.Remove(path); err == nil {
+		webhooksQueued.Add(-1)
+		counter.Add(1)
+	}
+}
+
+// postWebhook posts the webhook's data to the upstream, and reports whether
+// it should be tried again if it fails.
+func postWebhook(h webhook, data []byte) (bool, error) {
+	req, err := http.NewRequest("POST", webhookURL, bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Htee-Event", h.Type)
+	req.Header.Set("X-Htee-Delivery", h.ID)
+	req.Header.Set("X-Htee-Timestamp", timestamp)
+	req.Header.Set("X-Htee-Signature", signWebhook(timestamp, data))
+
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	res.Body.Close()
+
+	switch {
+	case res.StatusCode/100 == 2:
+		return false, nil
+	case res.StatusCode/100 == 4 && res.StatusCode != http.StatusRequestTimeout && res.StatusCode != 429:
+		return false, fmt.Errorf("Upstream rejected webhook with %s", res.Status)
+	default:
+		return true, fmt.Errorf("Upstream failed webhook with %s", res.Status)
+	}
+}
+
+func signWebhook(timestamp string, data []byte) string {
+	mac := hmac.New(sha256.New, []byte(webhookToken))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(data)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,103 @@
+package stream
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/htee/hteed/config"
+)
+
+func TestWebhooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hteed-webhooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	status := http.StatusInternalServerError
+	posted := make(chan webhook, 4)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		data, _ := ioutil.ReadAll(req.Body)
+
+		if sig := signWebhook(req.Header.Get("X-Htee-Timestamp"), data); req.Header.Get("X-Htee-Signature") != sig {
+			t.Errorf("webhook signature is %q, want %q", req.Header.Get("X-Htee-Signature"), sig)
+		}
+
+		var h webhook
+		if err := json.Unmarshal(data, &h); err != nil {
+			t.Error(err)
+		} else if req.Header.Get("X-Htee-Event") != h.Type || req.Header.Get("X-Htee-Delivery") != h.ID {
+			t.Errorf("webhook headers don't match its %s event %s", h.Type, h.ID)
+		}
+
+		res.WriteHeader(status)
+		posted <- h
+	}))
+	defer upstream.Close()
+
+	defer func() { webhookURL, webhookToken, webhookDir = "", "", "" }()
+	webhookURL, webhookToken, webhookDir = upstream.URL, "deadbeef", dir
+
+	s := &Stream{Name: "/alice/deploy", size: 42}
+	for _, event := range []string{"opened", "closed"} {
+		if err := s.announce(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	queued := func() int {
+		paths, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+		return len(paths)
+	}
+
+	// The upstream fails, so the first webhook is kept to be tried again and
+	// the second waits behind it.
+	if deliverQueued() {
+		t.Error("failed webhook wasn't kept to be retried")
+	} else if h := <-posted; h.Type != "opened" {
+		t.Errorf("posted %s webhook first, want opened", h.Type)
+	} else if n := queued(); n != 2 {
+		t.Errorf("%d webhooks queued, want 2", n)
+	}
+
+	status = http.StatusOK
+	if !deliverQueued() {
+		t.Error("webhooks weren't all delivered")
+	}
+
+	for _, want := range []string{"opened", "closed"} {
+		if h := <-posted; h.Type != want || h.Name != s.Name || h.Size != 42 {
+			t.Errorf("posted %+v, want %s webhook for %s", h, want, s.Name)
+		}
+	}
+
+	// Webhooks the upstream rejects are dropped.
+	status = http.StatusBadRequest
+	if err := s.announce("deleted"); err != nil {
+		t.Fatal(err)
+	} else if !deliverQueued() {
+		t.Error("rejected webhook was kept")
+	}
+	<-posted
+
+	if n := queued(); n != 0 {
+		t.Errorf("%d webhooks left queued, want 0", n)
+	}
+}
+
+func TestConfigureWebhooks(t *testing.T) {
+	for _, cnf := range []config.Config{
+		{WebURL: "", WebhookPath: "/hooks", WebhookDir: "/tmp/hooks"},
+		{WebURL: "http://web.example.com", WebhookPath: "/hooks"},
+	} {
+		if err := configureWebhooks(&cnf); err == nil {
+			t.Errorf("configured webhooks for %+v", cnf)
+		}
+	}
+}
@@ -0,0 +1,693 @@
+package stream
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/htee/hteed/Godeps/_workspace/src/github.com/garyburd/redigo/redis"
+)
+
+// A hub shares a single subscriber connection between every viewer in the
+// process. Viewers of a stream that arrive while its snapshot is being read
+// share that snapshot, and live messages are fanned out to every viewer of
+// the stream. The connection is closed once the last viewer leaves.
+type hub struct {
+	dial func() (redis.Conn, error)
+	get  func(name string) redis.Conn
+
+	// primary is set when dial and get go to a replica. Snapshots that find
+	// the stream finished, or missing, are taken again from the primary in
+	// case the replica hasn't caught up with it yet.
+	primary func(name string) redis.Conn
+
+	mu      sync.Mutex
+	drained *sync.Cond // signalled when viewers take queued data
+	sess    *session
+	topics  map[string]*topic
+	pending map[string]int // unanswered SUBSCRIBE commands by channel
+
+	attempts int // reconnections since a subscription was last confirmed
+}
+
+func newHub(dial func() (redis.Conn, error), get func(name string) redis.Conn) *hub {
+	h := &hub{
+		dial:    dial,
+		get:     get,
+		topics:  make(map[string]*topic),
+		pending: make(map[string]int),
+	}
+	h.drained = sync.NewCond(&h.mu)
+
+	return h
+}
+
+// A session is one subscriber connection. Commands are queued on the session
+// and written by its own goroutine so that the hub lock is never held while
+// waiting on the network.
+type session struct {
+	conn   redis.Conn
+	cmds   [][2]string
+	wake   chan struct{}
+	closed bool
+}
+
+func (s *session) send(cmd, channel string) {
+	if s.closed {
+		return
+	}
+
+	s.cmds = append(s.cmds, [2]string{cmd, channel})
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *session) close() {
+	if s.closed {
+		return
+	}
+
+	s.closed = true
+	close(s.wake)
+
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+// A topic is the set of viewers of one stream channel. Live viewers receive
+// messages as they are published, the others are waiting in a group.
+type topic struct {
+	name      string
+	channel   string
+	feed      bool // the channel carries raw events rather than stream data
+	confirmed bool
+	viewers   map[*viewer]bool
+	groups    map[*group]bool
+	open      *group // the group new viewers join
+}
+
+// A group is a set of viewers waiting on the same snapshot of the stream from
+// offset on. The offset moves along as the snapshot is read. Messages
+// received while the snapshot is read are held until it completes.
+type group struct {
+	offset  int64
+	viewers map[*viewer]bool
+	held    []message
+	started bool
+	stale   bool // the subscription reconnected while the snapshot was read
+}
+
+// A viewer receives the data of one stream for one playback. Live data queued
+// for the viewer is bounded by viewerBuffer, beyond which the slowViewer
+// policy applies.
+type viewer struct {
+	hub     *hub
+	topic   *topic
+	offset  int64 // offset after the last queued byte
+	queued  int64 // bytes queued in total
+	live    int64 // bytes of live messages queued
+	queue   []bufErr
+	ready   chan struct{}
+	stopped bool
+}
+
+func (h *hub) join(name string) *viewer {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	t := h.topic(name, (&Stream{Name: name}).streamKey(), false)
+
+	v := &viewer{
+		hub:   h,
+		topic: t,
+		ready: make(chan struct{}, 1),
+	}
+
+	if t.open == nil {
+		t.open = h.catchUp(t, 0)
+	}
+	t.open.viewers[v] = true
+
+	return v
+}
+
+// joinAt is join for a viewer starting at offset, which catches up from
+// there on its own.
+func (h *hub) joinAt(name string, offset int64) *viewer {
+	if offset == 0 {
+		return h.join(name)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	t := h.topic(name, (&Stream{Name: name}).streamKey(), false)
+
+	v := &viewer{
+		hub:    h,
+		topic:  t,
+		offset: offset,
+		ready:  make(chan struct{}, 1),
+	}
+	h.catchUp(t, offset).viewers[v] = true
+
+	return v
+}
+
+// listen returns a viewer receiving every message published on the feed
+// channel from now on, as is. Messages published while the subscription is
+// reconnecting are lost.
+func (h *hub) listen(channel string) *viewer {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	t := h.topic(channel, channel, true)
+
+	v := &viewer{
+		hub:   h,
+		topic: t,
+		ready: make(chan struct{}, 1),
+	}
+	t.viewers[v] = true
+
+	return v
+}
+
+// topic returns the topic for the channel, subscribing to it if it's new.
+func (h *hub) topic(name, channel string, feed bool) *topic {
+	if h.sess == nil {
+		h.sess = &session{wake: make(chan struct{}, 1)}
+		go h.run(h.sess)
+	}
+
+	t, ok := h.topics[channel]
+	if !ok {
+		t = &topic{
+			name:    name,
+			channel: channel,
+			feed:    feed,
+			viewers: make(map[*viewer]bool),
+			groups:  make(map[*group]bool),
+		}
+		h.topics[channel] = t
+
+		h.pending[channel]++
+		h.sess.send("SUBSCRIBE", channel)
+	}
+
+	return t
+}
+
+// catchUp starts a group reading the stream from offset on, as soon as the
+// topic's subscription is confirmed.
+func (h *hub) catchUp(t *topic, offset int64) *group {
+	g := &group{
+		offset:  offset,
+		viewers: make(map[*viewer]bool),
+	}
+	t.groups[g] = true
+
+	if t.confirmed {
+		h.fetch(t, g)
+	}
+
+	return g
+}
+
+func (h *hub) leave(v *viewer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	defer h.drained.Broadcast()
+
+	t := v.topic
+	delete(t.viewers, v)
+
+	for g := range t.groups {
+		delete(g.viewers, v)
+
+		if len(g.viewers) == 0 {
+			h.drop(t, g)
+		}
+	}
+
+	if len(t.viewers) > 0 || len(t.groups) > 0 || h.topics[t.channel] != t {
+		return
+	}
+
+	delete(h.topics, t.channel)
+
+	if len(h.topics) == 0 {
+		h.sess.close()
+		h.sess = nil
+		h.pending = make(map[string]int)
+	} else {
+		h.sess.send("UNSUBSCRIBE", t.channel)
+	}
+}
+
+func (h *hub) run(sess *session) {
+	conn, err := h.dial()
+	if err != nil {
+		h.fail(sess, err)
+		return
+	}
+
+	h.mu.Lock()
+	if sess.closed {
+		h.mu.Unlock()
+		conn.Close()
+		return
+	}
+	sess.conn = conn
+	h.mu.Unlock()
+
+	go h.receive(sess, conn)
+
+	for range sess.wake {
+		h.mu.Lock()
+		cmds := sess.cmds
+		sess.cmds = nil
+		h.mu.Unlock()
+
+		for _, cmd := range cmds {
+			conn.Send(cmd[0], cmd[1])
+		}
+
+		if err := conn.Flush(); err != nil {
+			h.fail(sess, err)
+			return
+		}
+	}
+}
+
+func (h *hub) receive(sess *session, conn redis.Conn) {
+	psc := redis.PubSubConn{Conn: conn}
+
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			h.dispatch(sess, v.Channel, v.Data)
+		case redis.Subscription:
+			if v.Kind == "subscribe" {
+				h.confirm(sess, v.Channel)
+			}
+		case error:
+			h.fail(sess, v)
+			return
+		}
+	}
+}
+
+func (h *hub) dispatch(sess *session, channel string, data []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	t := h.topics[channel]
+	if h.sess != sess || t == nil {
+		return
+	}
+
+	if t.feed {
+		for v := range t.viewers {
+			v.deliverFeed(data)
+		}
+		return
+	}
+
+	m, err := decodeMessage(data)
+	if err != nil {
+		for v := range t.viewers {
+			v.push(bufErr{nil, err})
+		}
+		return
+	}
+
+	for g := range t.groups {
+		g.held = append(g.held, m)
+	}
+
+	for v := range t.viewers {
+		v.deliver(m, true)
+	}
+}
+
+// confirm marks a topic as subscribed once every SUBSCRIBE sent for its
+// channel has been answered, so that a reply meant for an earlier topic on
+// the same channel isn't taken for the current one.
+func (h *hub) confirm(sess *session, channel string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.sess != sess {
+		return
+	}
+
+	if h.pending[channel]--; h.pending[channel] > 0 {
+		return
+	}
+	delete(h.pending, channel)
+
+	h.attempts = 0
+
+	if t := h.topics[channel]; t != nil {
+		t.confirmed = true
+
+		for g := range t.groups {
+			if !g.started {
+				h.fetch(t, g)
+			}
+		}
+	}
+}
+
+// fail ends a session whose connection broke. While retries remain, a new
+// session subscribes to every topic again, otherwise every viewer gets the
+// error.
+func (h *hub) fail(sess *session, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.sess != sess {
+		return
+	}
+
+	h.sess = nil
+	h.pending = make(map[string]int)
+	sess.close()
+
+	if len(h.topics) > 0 && h.attempts < retries {
+		h.attempts++
+		h.resubscribe(retryDelay(h.attempts))
+		return
+	}
+
+	h.attempts = 0
+
+	for _, t := range h.topics {
+		for v := range t.viewers {
+			v.push(bufErr{nil, err})
+		}
+
+		for g := range t.groups {
+			for v := range g.viewers {
+				v.push(bufErr{nil, err})
+			}
+		}
+	}
+
+	h.topics = make(map[string]*topic)
+}
+
+// resubscribe starts a new session after delay, subscribed to every topic.
+// Messages published while disconnected are lost, so live viewers catch up
+// from their offset once their topic is confirmed, and snapshots already
+// being read are followed by another one.
+func (h *hub) resubscribe(delay time.Duration) {
+	sess := &session{wake: make(chan struct{}, 1)}
+	h.sess = sess
+
+	for _, t := range h.topics {
+		t.confirmed = false
+
+		// Feed viewers just miss the messages published meanwhile.
+		for v := range t.viewers {
+			if !t.feed {
+				delete(t.viewers, v)
+				h.catchUp(t, v.offset).viewers[v] = true
+			}
+		}
+
+		for g := range t.groups {
+			if g.started {
+				g.stale = true
+			}
+		}
+
+		h.pending[t.channel]++
+		sess.send("SUBSCRIBE", t.channel)
+	}
+
+	time.AfterFunc(delay, func() { h.run(sess) })
+}
+
+func (h *hub) fetch(t *topic, g *group) {
+	g.started = true
+
+	go h.snapshot(t, g)
+}
+
+func (h *hub) drop(t *topic, g *group) {
+	delete(t.groups, g)
+
+	if t.open == g {
+		t.open = nil
+	}
+}
+
+// snapshot reads the stream for a group in pages of snapshotPage bytes, then
+// hands its viewers over to the live messages held in the meantime. Reads
+// that fail on a broken connection are retried from where they stopped.
+func (h *hub) snapshot(t *topic, g *group) {
+	state, ok, err := h.read(t, g)
+
+	for attempt := 1; ok && transient(err) && attempt <= retries; attempt++ {
+		time.Sleep(retryDelay(attempt))
+		state, ok, err = h.read(t, g)
+	}
+
+	if !ok {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.drop(t, g)
+
+	for v := range g.viewers {
+		if err != nil {
+			v.push(bufErr{nil, err})
+			continue
+		}
+
+		if state != Opened {
+			v.push(bufErr{nil, io.EOF})
+			continue
+		}
+
+		for _, m := range g.held {
+			v.deliver(m, false)
+		}
+
+		// Messages may have been missed while the subscription was
+		// reconnecting, so the viewer catches up again.
+		if g.stale {
+			h.catchUp(t, v.offset).viewers[v] = true
+			continue
+		}
+
+		t.viewers[v] = true
+	}
+}
+
+// read queues the stream from the group's offset on for its viewers, moving
+// the offset along as pages are queued. It reports false once the group has
+// no viewers left.
+func (h *hub) read(t *topic, g *group) (State, bool, error) {
+	s := &Stream{Name: t.name, conn: h.get(t.name)}
+	defer func() { s.conn.Close() }()
+
+	state, size, err := s.snapshot()
+
+	if err == nil && state != Opened && h.primary != nil {
+		s.conn.Close()
+		s.conn = h.primary(t.name)
+
+		state, size, err = s.snapshot()
+	}
+
+	for err == nil && g.offset < size {
+		end := g.offset + int64(snapshotPage)
+		if snapshotPage <= 0 || end > size {
+			end = size
+		}
+
+		var buf []byte
+		if buf, err = s.readRange(g.offset, end); err != nil {
+			break
+		}
+
+		if !h.page(t, g, message{Opened, g.offset, buf}) {
+			return state, false, nil
+		}
+
+		// The data was deleted while it was being read.
+		if int64(len(buf)) < end-g.offset {
+			break
+		}
+
+		g.offset = end
+	}
+
+	return state, true, err
+}
+
+// page queues a page of a snapshot for the group's viewers once they have
+// taken the previous one, so that at most a page or so is buffered for each.
+// The group is paced by its slowest viewer. It reports false once the group
+// has no viewers left.
+func (h *hub) page(t *topic, g *group, m message) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for h.behind(g) {
+		h.drained.Wait()
+	}
+
+	// Viewers joining from now on would miss this page.
+	if t.open == g {
+		t.open = nil
+	}
+
+	for v := range g.viewers {
+		v.deliver(m, false)
+	}
+
+	return len(g.viewers) > 0
+}
+
+func (h *hub) behind(g *group) bool {
+	for v := range g.viewers {
+		if snapshotPage > 0 && v.queued >= int64(snapshotPage) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// deliver queues the part of m that the viewer hasn't seen yet. Only live
+// messages count against the viewer's buffer, data read while catching up is
+// always queued.
+func (v *viewer) deliver(m message, live bool) {
+	if m.state != Opened {
+		v.push(bufErr{nil, io.EOF})
+		return
+	}
+
+	end := m.offset + int64(len(m.buf))
+	if end <= v.offset || v.stopped {
+		return
+	}
+
+	buf := m.buf
+	if m.offset < v.offset {
+		buf = buf[v.offset-m.offset:]
+	}
+
+	if live && viewerBuffer > 0 && v.live+int64(len(buf)) > int64(viewerBuffer) {
+		v.overflow(end)
+		return
+	}
+
+	v.offset = end
+	v.queued += int64(len(buf))
+	if live {
+		v.live += int64(len(buf))
+	}
+
+	v.push(bufErr{buf, nil})
+}
+
+// deliverFeed queues a message of a feed. Like live stream data, it counts
+// against the viewer's buffer, but a feed can't be skipped ahead or caught up
+// on, so a viewer whose buffer is full is stopped with ErrSlowViewer.
+func (v *viewer) deliverFeed(data []byte) {
+	if v.stopped {
+		return
+	}
+
+	if viewerBuffer > 0 && v.live+int64(len(data)) > int64(viewerBuffer) {
+		v.stopped = true
+		v.push(bufErr{nil, ErrSlowViewer})
+		return
+	}
+
+	v.live += int64(len(data))
+	v.push(bufErr{data, nil})
+}
+
+// overflow applies the slow viewer policy when the viewer's buffer is full
+// and the data up to end can't be queued. Both "resync" and "gap" drop the
+// queued data and skip the viewer ahead to end, the live offset, reporting a
+// Gap. With "resync" the viewer then catches up from the stream's data, so
+// that nothing published from end on is missed.
+func (v *viewer) overflow(end int64) {
+	switch slowViewer {
+	case "resync":
+		t := v.topic
+		delete(t.viewers, v)
+
+		v.skip(end)
+
+		v.hub.catchUp(t, v.offset).viewers[v] = true
+	case "gap":
+		v.skip(end)
+	default:
+		v.stopped = true
+		v.push(bufErr{nil, ErrSlowViewer})
+	}
+}
+
+// skip drops the data queued for the viewer and moves it on to end, queueing
+// a Gap for what was skipped in place of any earlier one not yet taken.
+func (v *viewer) skip(end int64) {
+	gap := Gap{Offset: v.offset - v.queued}
+	if len(v.queue) > 0 {
+		if prev, ok := v.queue[0].err.(Gap); ok {
+			gap.Offset = prev.Offset
+		}
+	}
+	gap.Length = end - gap.Offset
+
+	v.offset = end
+	v.reset()
+	v.push(bufErr{nil, gap})
+}
+
+func (v *viewer) reset() {
+	v.queue = nil
+	v.queued = 0
+	v.live = 0
+}
+
+func (v *viewer) push(be bufErr) {
+	if v.stopped && be.err != ErrSlowViewer {
+		return
+	}
+
+	v.queue = append(v.queue, be)
+
+	select {
+	case v.ready <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the data queued for the viewer since the last call.
+func (v *viewer) take() []bufErr {
+	v.hub.mu.Lock()
+	defer v.hub.mu.Unlock()
+
+	queue := v.queue
+	v.reset()
+	v.hub.drained.Broadcast()
+
+	return queue
+}
+
+func (v *viewer) leave() { v.hub.leave(v) }
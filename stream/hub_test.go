@@ -0,0 +1,353 @@
+package stream
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/htee/hteed/Godeps/_workspace/src/github.com/garyburd/redigo/redis"
+)
+
+func TestHubSharesSubscription(t *testing.T) {
+	rConn, nConn := redisPipeConn()
+
+	var snapshots int32
+	h := newHub(func() (redis.Conn, error) { return rConn, nil }, func(string) redis.Conn {
+		atomic.AddInt32(&snapshots, 1)
+
+		return &fakeConn{replies: map[string]interface{}{
+			"EXEC":     []interface{}{[]byte("1"), []interface{}{}, int64(7)},
+			"GETRANGE": []byte("Hello, "),
+		}}
+	})
+
+	name := "shared-stream"
+	viewers := []*viewer{h.join(name), h.join(name)}
+
+	subscribe := respCommand("SUBSCRIBE", name)
+	buf := make([]byte, len(subscribe)+1)
+	if n, err := nConn.Read(buf); err != nil {
+		t.Fatal(err)
+	} else if string(buf[:n]) != subscribe {
+		t.Fatalf("subscriber sent %q, want %q", buf[:n], subscribe)
+	}
+
+	go func() {
+		nConn.Write([]byte(respSubscribed(name)))
+		nConn.Write([]byte(respMessage(name, message{Opened, 0, []byte("Hello, ")})))
+		nConn.Write([]byte(respMessage(name, message{Opened, 7, []byte("World!")})))
+		nConn.Write([]byte(respMessage(name, message{Closed, 13, nil})))
+	}()
+
+	for i, v := range viewers {
+		if out, err := readViewer(v); err != nil {
+			t.Errorf("viewer %d: %s", i, err)
+		} else if out != "Hello, World!" {
+			t.Errorf("viewer %d received %q, want %q", i, out, "Hello, World!")
+		}
+	}
+
+	if n := atomic.LoadInt32(&snapshots); n != 1 {
+		t.Errorf("hub read %d snapshots, want 1", n)
+	}
+
+	for _, v := range viewers {
+		v.leave()
+	}
+
+	if _, err := nConn.Write([]byte("write on closed connection")); err == nil {
+		t.Error("Conn was not closed after the last viewer left")
+	}
+}
+
+func readViewer(v *viewer) (string, error) {
+	var out []byte
+
+	for {
+		select {
+		case <-v.ready:
+			for _, be := range v.take() {
+				if be.err == io.EOF {
+					return string(out), nil
+				} else if be.err != nil {
+					return string(out), be.err
+				}
+
+				out = append(out, be.buf...)
+			}
+		case <-time.After(time.Second):
+			return string(out), fmt.Errorf("timed out after %q", out)
+		}
+	}
+}
+
+func respCommand(args ...string) string {
+	cmd := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		cmd += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	return cmd
+}
+
+func respSubscribed(channel string) string {
+	return fmt.Sprintf("*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:1\r\n", len(channel), channel)
+}
+
+func respMessage(channel string, m message) string {
+	data := m.encode()
+
+	return fmt.Sprintf("*3\r\n$7\r\nmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n",
+		len(channel), channel, len(data), data)
+}
+
+// fakeConn is a redis.Conn that records commands and answers them with
+// canned replies.
+type fakeConn struct {
+	cmds    []string
+	replies map[string]interface{}
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Err() error { return nil }
+
+func (c *fakeConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	c.cmds = append(c.cmds, cmd)
+
+	if err, ok := c.replies[cmd].(error); ok {
+		return nil, err
+	}
+
+	return c.replies[cmd], nil
+}
+
+func (c *fakeConn) Send(cmd string, args ...interface{}) error {
+	c.cmds = append(c.cmds, cmd)
+
+	return nil
+}
+
+func (c *fakeConn) Flush() error { return nil }
+
+func (c *fakeConn) Receive() (interface{}, error) { return nil, nil }
+
+func TestSlowViewerPolicies(t *testing.T) {
+	defer func(size int, policy string) { viewerBuffer, slowViewer = size, policy }(viewerBuffer, slowViewer)
+	viewerBuffer = 8
+
+	newViewer := func() *viewer {
+		h := newHub(nil, nil)
+		tp := &topic{viewers: make(map[*viewer]bool), groups: make(map[*group]bool)}
+		v := &viewer{hub: h, topic: tp, ready: make(chan struct{}, 1)}
+		tp.viewers[v] = true
+
+		v.deliver(message{Opened, 0, []byte("0123")}, true)
+		v.deliver(message{Opened, 4, []byte("4567")}, true)
+		v.deliver(message{Opened, 8, []byte("89")}, true)
+
+		return v
+	}
+
+	slowViewer = "disconnect"
+	if q := newViewer().queue; len(q) != 3 || q[2].err != ErrSlowViewer {
+		t.Errorf("disconnect policy queued %v, want ErrSlowViewer", q)
+	}
+
+	slowViewer = "gap"
+	v := newViewer()
+	v.deliver(message{Opened, 10, []byte("ab")}, true)
+	if len(v.queue) != 2 || v.queue[0].err != (Gap{0, 10}) || string(v.queue[1].buf) != "ab" {
+		t.Errorf("gap policy queued %v, want a 10 byte gap then data", v.queue)
+	}
+
+	slowViewer = "resync"
+	v = newViewer()
+	if len(v.queue) != 1 || v.queue[0].err != (Gap{0, 10}) || v.topic.viewers[v] {
+		t.Errorf("resync policy left the viewer live with %v queued, want a 10 byte gap", v.queue)
+	}
+	for g := range v.topic.groups {
+		if !g.viewers[v] || g.offset != 10 {
+			t.Errorf("resync policy catches up from %d, want 10", g.offset)
+		}
+	}
+}
+
+func TestSlowFeedViewer(t *testing.T) {
+	defer func(size int) { viewerBuffer = size }(viewerBuffer)
+	viewerBuffer = 8
+
+	tp := &topic{feed: true, viewers: make(map[*viewer]bool), groups: make(map[*group]bool)}
+	v := &viewer{hub: newHub(nil, nil), topic: tp, ready: make(chan struct{}, 1)}
+	tp.viewers[v] = true
+
+	for _, data := range []string{"0123", "4567", "89", "ab"} {
+		v.deliverFeed([]byte(data))
+	}
+
+	if len(v.queue) != 3 || v.queue[2].err != ErrSlowViewer {
+		t.Errorf("feed queued %v, want ErrSlowViewer after 8 bytes", v.queue)
+	}
+}
+
+func TestPagedSnapshot(t *testing.T) {
+	defer func(size int) { snapshotPage = size }(snapshotPage)
+	snapshotPage = 4
+
+	data := "0123456789"
+	conn := &rangeConn{data: data}
+
+	h := newHub(nil, func(string) redis.Conn { return conn })
+	tp := &topic{name: "paged-stream", viewers: make(map[*viewer]bool), groups: make(map[*group]bool)}
+	v := &viewer{hub: h, topic: tp, ready: make(chan struct{}, 1)}
+
+	g := &group{offset: 2, viewers: map[*viewer]bool{v: true}}
+	tp.groups[g] = true
+
+	// Published while the snapshot is read, overlapping its last page.
+	g.held = []message{{Opened, 8, []byte("89ab")}, {Closed, 12, nil}}
+
+	go h.snapshot(tp, g)
+
+	if out, err := readViewer(v); err != nil {
+		t.Error(err)
+	} else if out != "23456789ab" {
+		t.Errorf("viewer received %q, want %q", out, "23456789ab")
+	}
+
+	if want := [][2]int64{{2, 5}, {6, 9}}; fmt.Sprint(conn.ranges) != fmt.Sprint(want) {
+		t.Errorf("snapshot read ranges %v, want %v", conn.ranges, want)
+	}
+}
+
+// rangeConn is a redis.Conn serving the snapshot of an open stream.
+type rangeConn struct {
+	fakeConn
+
+	data   string
+	ranges [][2]int64
+}
+
+func (c *rangeConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	switch cmd {
+	case "EXEC":
+		return []interface{}{[]byte("1"), []interface{}{}, int64(len(c.data))}, nil
+	case "GETRANGE":
+		start, end := args[1].(int64), args[2].(int64)
+		c.ranges = append(c.ranges, [2]int64{start, end})
+
+		return []byte(c.data[start : end+1]), nil
+	}
+
+	return c.fakeConn.Do(cmd, args...)
+}
+
+func TestReplicaSnapshot(t *testing.T) {
+	primary, replica := newMemConn(), newMemConn()
+
+	s := &Stream{Name: "/test/lagging", conn: primary}
+	if err := s.append([]byte("hello")); err != nil {
+		t.Fatal(err)
+	} else if err := s.finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	h := newHub(nil, func(string) redis.Conn { return replica })
+	h.primary = func(string) redis.Conn { return primary }
+
+	tp := &topic{name: s.Name, viewers: make(map[*viewer]bool), groups: make(map[*group]bool)}
+	v := &viewer{hub: h, topic: tp, ready: make(chan struct{}, 1)}
+
+	g := &group{viewers: map[*viewer]bool{v: true}}
+	tp.groups[g] = true
+
+	// The replica hasn't received the stream yet.
+	go h.snapshot(tp, g)
+
+	if out, err := readViewer(v); err != nil {
+		t.Error(err)
+	} else if out != "hello" {
+		t.Errorf("viewer received %q, want %q", out, "hello")
+	}
+}
+
+func TestHubResubscribes(t *testing.T) {
+	defer func(n int, d func(int) time.Duration) { retries, retryDelay = n, d }(retries, retryDelay)
+	retries, retryDelay = 3, backoff(time.Millisecond)
+
+	var mu sync.Mutex
+	data := ""
+
+	dials := make(chan net.Conn, 2)
+	h := newHub(func() (redis.Conn, error) {
+		rConn, nConn := redisPipeConn()
+		dials <- nConn
+
+		return rConn, nil
+	}, func(string) redis.Conn {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return &rangeConn{data: data}
+	})
+
+	name := "reconnected-stream"
+	v := h.join(name)
+
+	subscribe := func() net.Conn {
+		nConn := <-dials
+
+		buf := make([]byte, 64)
+		if _, err := nConn.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+
+		go nConn.Write([]byte(respSubscribed(name)))
+
+		return nConn
+	}
+
+	nConn := subscribe()
+	go nConn.Write([]byte(respMessage(name, message{Opened, 0, []byte("Hello, ")})))
+
+	var out []byte
+	for len(out) < 7 {
+		select {
+		case <-v.ready:
+			for _, be := range v.take() {
+				if be.err != nil {
+					t.Fatal(be.err)
+				}
+				out = append(out, be.buf...)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out after %q", out)
+		}
+	}
+
+	// Published while the subscriber is disconnected.
+	mu.Lock()
+	data = "Hello, World"
+	mu.Unlock()
+
+	nConn.Close()
+
+	nConn = subscribe()
+	go func() {
+		nConn.Write([]byte(respMessage(name, message{Opened, 7, []byte("World")})))
+		nConn.Write([]byte(respMessage(name, message{Opened, 12, []byte("!")})))
+		nConn.Write([]byte(respMessage(name, message{Closed, 13, nil})))
+	}()
+
+	if rest, err := readViewer(v); err != nil {
+		t.Error(err)
+	} else if string(out)+rest != "Hello, World!" {
+		t.Errorf("viewer received %q, want %q", string(out)+rest, "Hello, World!")
+	}
+
+	v.leave()
+}
@@ -2,39 +2,244 @@ package stream
 
 import (
 	"io"
+	"sync"
+	"time"
 
 	"github.com/htee/hteed/Godeps/_workspace/src/code.google.com/p/go.net/context"
+	"github.com/htee/hteed/Godeps/_workspace/src/github.com/garyburd/redigo/redis"
 )
 
-func In(ctx context.Context, name string, reader io.Reader) *Stream {
+var (
+	flushInterval time.Duration
+	flushSize     int
+
+	bufPool = sync.Pool{
+		New: func() interface{} { return make([]byte, readSize) },
+	}
+)
+
+const (
+	readSize = 4096
+
+	defaultFlushInterval = 10 * time.Millisecond
+	defaultFlushSize     = 64 << 10
+)
+
+// Open takes the exclusive writer lease on the stream, so that it can be
+// recorded. If another recording holds it, Open fails with
+// ErrWriterConflict, or with the "queue" writer-conflict policy waits for it
+// to be released. The recording is appended to the data the stream already
+// holds, if any.
+func Open(ctx context.Context, name string) (*Stream, error) {
+	s, err := acquireStream(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.reopen(); err != nil {
+		s.drop()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Replace opens the stream like Open, and deletes its existing data, so that
+// the recording replaces it.
+func Replace(ctx context.Context, name string) (*Stream, error) {
+	s, err := acquireStream(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.clear(); err != nil {
+		s.drop()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Reopen opens the stream like Open, for the recording to be appended to its
+// existing data. Unlike Open, it fails with ErrNoStream rather than record a
+// stream that doesn't exist yet.
+func Reopen(ctx context.Context, name string) (*Stream, error) {
+	s, err := acquireStream(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := redis.Bool(s.conn.Do("EXISTS", s.stateKey()))
+	if err == nil && !exists {
+		err = ErrNoStream
+	}
+	if err == nil {
+		err = s.reopen()
+	}
+	if err != nil {
+		s.drop()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// acquireStream takes the stream's writer lease, without reading its
+// existing data.
+func acquireStream(ctx context.Context, name string) (*Stream, error) {
 	s := newStream(ctx, name)
+	s.segmentSize = segmentSize
+	s.redactor = newRedactor(redactions(ctx))
 
-	go streamIn(s, reader)
+	if err := s.acquire(); err != nil {
+		s.close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// reopen carries the stream on after the data it already holds.
+func (s *Stream) reopen() error {
+	r := &Stream{Name: s.Name, conn: s.conn}
+
+	state, size, err := r.snapshot()
+	if err != nil {
+		return err
+	}
+
+	if err := r.unseal(size); err != nil {
+		return err
+	}
+
+	// A stream that had ended is announced again once it's appended to.
+	if state != Opened && size > 0 {
+		s.reopened = size
+	}
+
+	return s.adopt(r, size)
+}
+
+// adopt carries on the stream after the size bytes already stored, with the
+// layout read into r.
+func (s *Stream) adopt(r *Stream, size int64) error {
+	if size > 0 {
+		s.segmentSize = r.segmentSize
+	}
+	s.size = size
+
+	return s.resumeCompression()
+}
+
+// Remaining returns how many more bytes the recorder can send before the
+// stream holds max bytes. Data that a resumed recorder sends again doesn't
+// count, since it's skipped.
+func (s *Stream) Remaining(max int64) int64 {
+	if s.size >= max {
+		return 0
+	}
 
-	return s
+	return max - s.size + s.skip
+}
+
+// Record records the reader's data into the opened stream.
+func (s *Stream) Record(reader io.Reader) {
+	if s.skip > 0 {
+		reader = &skipReader{reader, s.skip}
+	}
+
+	go streamIn(s, reader)
 }
 
 func streamIn(s *Stream, reader io.Reader) {
 	defer closeIn(s)
 
+	var err error
+	if s.watcher, err = loadWatcher(s.Name); err != nil {
+		s.Err = err
+		return
+	}
+
 	bufErrChan := make(chan bufErr)
 
 	go drain(bufErrChan, reader)
 
+	// Reads are coalesced into a batch that is appended once it reaches
+	// flushSize bytes or has waited for flushInterval.
+	var flush <-chan time.Time
+
+	// Data held back by the redactor or the marker scanner is released once
+	// the recorder has been idle for a while, so that live viewers aren't left
+	// waiting on it. Alerts waiting for the lines after their match are sent
+	// then too.
+	var idle <-chan time.Time
+
+	// The writer's lease is renewed while the recording runs. Renewals that
+	// fail are tried again on the next tick, but a lease taken over by another
+	// writer ends the recording.
+	var renew <-chan time.Time
+	if leaseTTL > 0 {
+		ticker := time.NewTicker(leaseTTL / 3)
+		defer ticker.Stop()
+
+		renew = ticker.C
+	}
+
 	for {
 		select {
 		case <-s.ctx.Done():
 			return
+		case <-renew:
+			if err := s.renew(); err == ErrLeaseLost {
+				s.Err = err
+				return
+			}
+		case <-flush:
+			flush = nil
+			if err := s.flush(); err != nil {
+				s.Err = err
+				return
+			}
+		case <-idle:
+			idle, flush = nil, nil
+			s.queueHeld()
+			s.alert(s.watcher.expire())
+			if err := s.flush(); err != nil {
+				s.Err = err
+				return
+			}
 		case v, ok := <-bufErrChan:
-			if v.err == io.EOF || v.err == io.ErrUnexpectedEOF || !ok {
+			if v.err == io.EOF || !ok {
+				return
+			} else if v.err != nil && resumeTimeout > 0 {
+				// The recorder's connection dropped.
+				s.suspended = true
+				return
+			} else if v.err == io.ErrUnexpectedEOF {
 				return
 			} else if v.err != nil {
+				// The recording can't be resumed, so it's aborted with
+				// what it received.
 				s.Err = v.err
+				s.final = Aborted
 				return
 			} else {
-				if err := s.append(v.buf); err != nil {
-					s.Err = err
-					return
+				s.received += int64(len(v.buf))
+				s.queue(s.redactor.redact(v.buf))
+				bufPool.Put(v.buf[:cap(v.buf)])
+
+				if len(s.batch) >= flushSize {
+					flush = nil
+					if err := s.flush(); err != nil {
+						s.Err = err
+						return
+					}
+				} else if flush == nil && len(s.batch) > 0 {
+					flush = time.After(flushInterval)
+				}
+
+				if s.redactor.buffered() || s.scanner.buffered() || s.watcher.waiting() {
+					idle = time.After(redactIdleFlush)
 				}
 			}
 		}
@@ -45,11 +250,13 @@ func drain(bufErrChan chan<- bufErr, reader io.Reader) {
 	defer close(bufErrChan)
 
 	for {
-		buf := make([]byte, 4096)
+		buf := bufPool.Get().([]byte)
 
 		if n, err := reader.Read(buf); err != nil {
 			if n > 0 {
 				bufErrChan <- bufErr{buf[:n], nil}
+			} else {
+				bufPool.Put(buf)
 			}
 
 			bufErrChan <- bufErr{nil, err}
@@ -63,6 +270,44 @@ func drain(bufErrChan chan<- bufErr, reader io.Reader) {
 func closeIn(s *Stream) {
 	defer s.close()
 
+	// The stream belongs to another writer now.
+	if s.Err == ErrLeaseLost {
+		return
+	}
+
+	// The recording can be resumed once everything received is stored,
+	// except for the data the redactor holds back, which is kept to be
+	// redacted along with the resumed data.
+	resumable := s.suspended && resumeTimeout > 0
+
+	if s.Err == nil || s.final == Aborted {
+		if !resumable {
+			s.queue(s.redactor.flush())
+		}
+		s.batchData(s.scanner.flush())
+		s.alert(s.watcher.flush())
+
+		if err := s.flush(); err != nil {
+			s.Err = err
+		}
+	}
+
+	if resumable && s.Err == nil {
+		if s.spool == nil {
+			if err := s.suspend(); err != nil {
+				s.Err = err
+			}
+			return
+		}
+
+		// A spooled recording can't be resumed, so it's finished with
+		// everything it received.
+		s.queueHeld()
+		if err := s.flush(); err != nil {
+			s.Err = err
+		}
+	}
+
 	if err := s.finish(); err != nil {
 		s.Err = err
 	}
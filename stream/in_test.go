@@ -2,13 +2,15 @@ package stream
 
 import (
 	"io"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/htee/hteed/Godeps/_workspace/src/code.google.com/p/go.net/context"
 )
 
 func TestCancelIn(t *testing.T) {
-	r, _ := io.Pipe()
+	r, w := io.Pipe()
 	rConn, nConn := redisPipeConn()
 
 	s := &Stream{
@@ -18,7 +20,11 @@ func TestCancelIn(t *testing.T) {
 		done: make(chan struct{}),
 	}
 
-	go streamIn(s, r)
+	exited := make(chan struct{})
+	go func() {
+		streamIn(s, r)
+		close(exited)
+	}()
 
 	s.Cancel()
 
@@ -30,4 +36,177 @@ func TestCancelIn(t *testing.T) {
 	if err == nil {
 		t.Error("Conn was not closed by Cancel()")
 	}
+
+	w.Close()
+	<-exited
 }
+
+func TestAppendAndReplace(t *testing.T) {
+	defer func(ttl time.Duration, size int64, c string, r *ring) {
+		leaseTTL, segmentSize, compression, shards = ttl, size, c, r
+	}(leaseTTL, segmentSize, compression, shards)
+	leaseTTL, segmentSize, compression = time.Minute, 4, "gzip"
+
+	conn := newMemConn()
+	shards = newRing(memShard("mem:6379", conn))
+
+	name := "/test/reopened"
+
+	record := func(open func(context.Context, string) (*Stream, error), data string) {
+		s, err := open(context.Background(), name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s.Record(strings.NewReader(data))
+		<-s.Done()
+
+		if s.Err != nil {
+			t.Fatal(s.Err)
+		}
+	}
+
+	check := func(want string) {
+		r := &Stream{Name: name, conn: conn}
+
+		state, size, err := r.snapshot()
+		if err != nil {
+			t.Fatal(err)
+		} else if state != Closed || size != int64(len(want)) {
+			t.Errorf("stream is %d bytes in state %d, want %d bytes closed", size, state, len(want))
+		}
+
+		if buf, err := r.readRange(0, size); err != nil || string(buf) != want {
+			t.Errorf("stream reads %q, %v, want %q", buf, err, want)
+		}
+	}
+
+	record(Open, "hello world")
+	check("hello world")
+
+	// Recording into an existing stream appends to it.
+	record(Open, "abc")
+	check("hello worldabc")
+
+	record(Reopen, "!")
+	check("hello worldabc!")
+
+	if _, err := Reopen(context.Background(), "/test/missing"); err != ErrNoStream {
+		t.Errorf("reopened a missing stream with %v, want ErrNoStream", err)
+	} else if _, ok := conn.strings[(&Stream{Name: "/test/missing"}).leaseKey()]; ok {
+		t.Error("failed reopen kept its lease")
+	}
+
+	record(Replace, "bye")
+	check("bye")
+
+	if _, ok := conn.strings[(&Stream{Name: name}).segmentKey(3)]; ok {
+		t.Error("replaced stream kept its old segments")
+	}
+
+	// The recorder's budget is what's left of the cap, across appends.
+	for _, remaining := range []int64{5, 1, 0} {
+		s, err := Open(context.Background(), name)
+		if err != nil {
+			t.Fatal(err)
+		} else if n := s.Remaining(8); n != remaining {
+			t.Errorf("%d bytes remaining, want %d", n, remaining)
+		}
+
+		s.Record(&io.LimitedReader{R: strings.NewReader("abcd"), N: s.Remaining(8)})
+		<-s.Done()
+	}
+	check("byeabcda")
+}
+
+func BenchmarkStreamInUnbatched(b *testing.B) { benchmarkStreamIn(b, 1) }
+
+func BenchmarkStreamInBatched(b *testing.B) { benchmarkStreamIn(b, defaultFlushSize) }
+
+// benchmarkStreamIn records 1MB per iteration from a recorder making 64 byte
+// writes, and reports the number of redis commands and transactions per MB.
+func benchmarkStreamIn(b *testing.B, size int) {
+	defer func(size int, interval time.Duration) {
+		flushSize, flushInterval = size, interval
+	}(flushSize, flushInterval)
+	flushSize, flushInterval = size, defaultFlushInterval
+
+	conn := &countingConn{}
+
+	b.SetBytes(MB)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		s := &Stream{
+			conn: conn,
+			ctx:  context.Background(),
+			Name: "benchmark-in-stream",
+			done: make(chan struct{}),
+		}
+
+		streamIn(s, &chunkReader{n: MB, chunk: 64})
+	}
+
+	b.ReportMetric(float64(conn.cmds)/float64(b.N), "ops/MB")
+	b.ReportMetric(float64(conn.txns)/float64(b.N), "txns/MB")
+}
+
+const MB = 1 << 20
+
+// chunkReader returns n zero bytes, chunk bytes at a time.
+type chunkReader struct {
+	n, chunk int
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if r.n == 0 {
+		return 0, io.EOF
+	}
+
+	n := r.chunk
+	if n > r.n {
+		n = r.n
+	}
+	if n > len(p) {
+		n = len(p)
+	}
+
+	for i := range p[:n] {
+		p[i] = 0
+	}
+	r.n -= n
+
+	return n, nil
+}
+
+// countingConn is a redis.Conn that counts the commands sent to it.
+type countingConn struct {
+	cmds, txns int
+}
+
+func (c *countingConn) Close() error { return nil }
+
+func (c *countingConn) Err() error { return nil }
+
+func (c *countingConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	c.Send(cmd, args...)
+
+	if cmd == "EXEC" {
+		return []interface{}{}, nil
+	}
+
+	return nil, nil
+}
+
+func (c *countingConn) Send(cmd string, args ...interface{}) error {
+	c.cmds++
+	if cmd == "EXEC" {
+		c.txns++
+	}
+
+	return nil
+}
+
+func (c *countingConn) Flush() error { return nil }
+
+func (c *countingConn) Receive() (interface{}, error) { return nil, nil }
@@ -0,0 +1,228 @@
+package stream
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/htee/hteed/Godeps/_workspace/src/github.com/garyburd/redigo/redis"
+)
+
+const (
+	defaultListLimit = 20
+	maxListLimit     = 100
+)
+
+// Streams are named after their owner, as in /owner/name. Every owner has an
+// index of their streams, a sorted set scored by the time each stream was
+// created, which lives on the shard its key hashes to. Each stream also keeps
+// its creation and finish times in its meta hash.
+
+// stateNames names the states in listings. State isn't a Stringer, since
+// states are written to redis as numbers.
+var stateNames = map[State]string{
+	Closed:  "closed",
+	Opened:  "open",
+	Aborted: "aborted",
+}
+
+// ParseState returns the state with the name used in listings.
+func ParseState(name string) (State, bool) {
+	for state, n := range stateNames {
+		if n == name {
+			return state, true
+		}
+	}
+
+	return 0, false
+}
+
+func (s State) MarshalText() ([]byte, error) { return []byte(stateNames[s]), nil }
+
+// owner returns the owner of the named stream, or "" if it has none.
+func owner(name string) string {
+	parts := strings.SplitN(strings.TrimPrefix(name, "/"), "/", 2)
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return ""
+	}
+
+	return parts[0]
+}
+
+func ownerKey(owner string) string { return keyPrefix + "owner:" + owner }
+
+func (s *Stream) metaKey() string { return s.key("meta:") }
+
+// list adds the stream to its owner's index, or removes it with ZREM.
+func (s *Stream) list(cmd string, args ...interface{}) error {
+	o := owner(s.Name)
+	if o == "" || shards == nil {
+		return nil
+	}
+
+	key := ownerKey(o)
+	conn := s.connTo(shards.shard(key), key)
+	defer conn.Close()
+
+	_, err := conn.Do(cmd, append([]interface{}{ownerKey(o)}, args...)...)
+
+	return err
+}
+
+func ownerConn(owner string) redis.Conn {
+	key := ownerKey(owner)
+
+	return shards.shard(key).servers.conn(key)
+}
+
+func millis(t time.Time) int64 { return t.UnixNano() / int64(time.Millisecond) }
+
+func fromMillis(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC()
+}
+
+// An Info describes a stream in its owner's listing.
+type Info struct {
+	Name     string     `json:"name"`
+	State    State      `json:"state"`
+	Size     int64      `json:"size"`
+	Created  time.Time  `json:"created"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Markers  []Marker   `json:"markers,omitempty"`
+}
+
+// A ListOptions selects the streams returned by List. The next page of a
+// listing starts before the last stream listed, which is given by its
+// creation time and name: streams created in the same millisecond are
+// ordered by name.
+type ListOptions struct {
+	Before time.Time // only streams created before, if set
+	Last   string    // with Before, also streams created then ordered after Last
+	Limit  int       // the number of streams, up to maxListLimit
+	States []State   // only streams in one of the states, if any
+}
+
+// List returns the owner's streams, newest first, and whether there may be
+// more of them after the last one. A stream's index entry is dropped if the
+// stream no longer exists.
+func List(owner string, opts ListOptions) ([]Info, bool, error) {
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = defaultListLimit
+	} else if limit > maxListLimit {
+		limit = maxListLimit
+	}
+
+	max := "+inf"
+	if !opts.Before.IsZero() {
+		max = strconv.FormatInt(millis(opts.Before), 10)
+		if opts.Last == "" {
+			max = "(" + max
+		}
+	}
+
+	conn := ownerConn(owner)
+	defer conn.Close()
+
+	// Index entries are read in pages by offset from max, since many
+	// streams may share a score.
+	var infos []Info
+	for offset := 0; ; {
+		reply, err := redis.Strings(conn.Do("ZREVRANGEBYSCORE", ownerKey(owner), max, "-inf", "WITHSCORES", "LIMIT", offset, limit))
+		if err != nil {
+			return nil, false, err
+		}
+
+		for i := 0; i+1 < len(reply); i += 2 {
+			name, score := reply[i], reply[i+1]
+			offset++
+
+			if opts.Last != "" && name >= opts.Last {
+				if ms, err := strconv.ParseFloat(score, 64); err == nil && int64(ms) == millis(opts.Before) {
+					continue
+				}
+			}
+
+			info, ok, err := stat(conn, name)
+			if err != nil {
+				return nil, false, err
+			} else if !ok {
+				conn.Do("ZREM", ownerKey(owner), name)
+				offset--
+				continue
+			} else if !hasState(opts.States, info.State) {
+				continue
+			}
+
+			infos = append(infos, info)
+			if len(infos) == limit {
+				return infos, true, nil
+			}
+		}
+
+		if len(reply) < 2*limit {
+			return infos, false, nil
+		}
+	}
+}
+
+func hasState(states []State, state State) bool {
+	if len(states) == 0 {
+		return true
+	}
+
+	for _, s := range states {
+		if s == state {
+			return true
+		}
+	}
+
+	return false
+}
+
+// stat returns the stream's info, and whether it exists. The connection to
+// the owner's index is held meanwhile.
+func stat(held redis.Conn, name string) (Info, bool, error) {
+	s := &Stream{Name: name, conn: held}
+	s.conn = s.connTo(shards.shard(name), s.stateKey())
+	defer s.conn.Close()
+
+	state, size, err := s.snapshot()
+	if err != nil {
+		return Info{}, false, err
+	}
+
+	fields, err := redis.Strings(s.conn.Do("HGETALL", s.metaKey()))
+	if err != nil {
+		return Info{}, false, err
+	}
+
+	meta := make(map[string]int64)
+	for i := 0; i+1 < len(fields); i += 2 {
+		if meta[fields[i]], err = strconv.ParseInt(fields[i+1], 10, 64); err != nil {
+			return Info{}, false, err
+		}
+	}
+
+	if _, ok := meta["created"]; !ok {
+		return Info{}, false, nil
+	}
+
+	info := Info{
+		Name:    name,
+		State:   state,
+		Size:    size,
+		Created: fromMillis(meta["created"]),
+	}
+
+	if finished, ok := meta["finished"]; ok {
+		t := fromMillis(finished)
+		info.Finished = &t
+	}
+
+	if info.Markers, err = s.markers(); err != nil {
+		return Info{}, false, err
+	}
+
+	return info, true, nil
+}
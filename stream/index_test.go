@@ -0,0 +1,121 @@
+package stream
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/htee/hteed/Godeps/_workspace/src/code.google.com/p/go.net/context"
+)
+
+func TestList(t *testing.T) {
+	defer func(r *ring) { shards = r }(shards)
+
+	conn := newMemConn()
+	shards = newRing(memShard("mem:6379", conn))
+
+	for _, name := range []string{"/alice/a", "/alice/b", "/alice/c", "/bob/x"} {
+		s := &Stream{Name: name, conn: conn}
+		if err := s.append([]byte(name)); err != nil {
+			t.Fatal(err)
+		}
+
+		switch name {
+		case "/alice/a":
+			if err := s.finish(); err != nil {
+				t.Fatal(err)
+			}
+		case "/alice/c":
+			s.final = Aborted
+			if err := s.finish(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Streams created in the same millisecond aren't ordered.
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	list := func(opts ListOptions) ([]string, ListOptions) {
+		infos, more, err := List("alice", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		for _, info := range infos {
+			names = append(names, info.Name)
+		}
+
+		if !more {
+			return names, ListOptions{}
+		}
+
+		last := infos[len(infos)-1]
+		opts.Before, opts.Last = last.Created, last.Name
+
+		return names, opts
+	}
+
+	if names, next := list(ListOptions{}); !reflect.DeepEqual(names, []string{"/alice/c", "/alice/b", "/alice/a"}) || next.Limit != 0 {
+		t.Errorf("listed %v, next %+v", names, next)
+	}
+
+	if names, _ := list(ListOptions{States: []State{Opened}}); !reflect.DeepEqual(names, []string{"/alice/b"}) {
+		t.Errorf("listed %v open streams, want /alice/b", names)
+	}
+
+	names, next := list(ListOptions{Limit: 2})
+	if !reflect.DeepEqual(names, []string{"/alice/c", "/alice/b"}) || next.Limit == 0 {
+		t.Errorf("listed %v on the first page, next %+v", names, next)
+	}
+
+	if names, next := list(next); !reflect.DeepEqual(names, []string{"/alice/a"}) || next.Limit != 0 {
+		t.Errorf("listed %v on the second page, next %+v", names, next)
+	}
+
+	// Streams created in the same millisecond aren't skipped between pages.
+	for _, name := range []string{"/alice/d", "/alice/e", "/alice/f"} {
+		conn.zsets[ownerKey("alice")][name] = 1e12
+		conn.hashes[(&Stream{Name: name}).metaKey()] = map[string][]byte{"created": []byte("1000000000000")}
+	}
+
+	var all []string
+	for next := (ListOptions{Limit: 2, Before: fromMillis(1e12 + 1)}); ; {
+		var names []string
+		names, next = list(next)
+		all = append(all, names...)
+
+		if next.Limit == 0 {
+			break
+		}
+	}
+
+	if want := []string{"/alice/f", "/alice/e", "/alice/d"}; !reflect.DeepEqual(all, want) {
+		t.Errorf("listed %v across pages, want %v", all, want)
+	}
+
+	for _, name := range []string{"/alice/d", "/alice/e", "/alice/f"} {
+		delete(conn.zsets[ownerKey("alice")], name)
+		delete(conn.hashes, (&Stream{Name: name}).metaKey())
+	}
+
+	infos, _, err := List("alice", ListOptions{States: []State{Closed}})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(infos) != 1 || infos[0].Size != 8 || infos[0].Finished == nil {
+		t.Errorf("closed streams are %+v", infos)
+	}
+
+	if err := StreamDelete(context.Background(), "/alice/b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := conn.zsets[ownerKey("alice")]["/alice/b"]; ok {
+		t.Error("deleted stream is still indexed")
+	}
+
+	if names, _ := list(ListOptions{}); !reflect.DeepEqual(names, []string{"/alice/c", "/alice/a"}) {
+		t.Errorf("listed %v after deleting /alice/b", names)
+	}
+}
@@ -0,0 +1,264 @@
+package stream
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/htee/hteed/Godeps/_workspace/src/github.com/garyburd/redigo/redis"
+)
+
+var (
+	leaseTTL       time.Duration
+	writerConflict string
+	writerQueue    time.Duration
+	sweeper        sync.Once
+
+	ErrWriterConflict = errors.New("Stream is being recorded by another writer")
+	ErrLeaseLost      = errors.New("Stream was taken over by another writer")
+)
+
+const (
+	defaultLeaseTTL    = 30 * time.Second
+	defaultWriterQueue = time.Minute
+	leaseRetry         = 250 * time.Millisecond
+)
+
+func validWriterConflictPolicy(policy string) bool {
+	switch policy {
+	case "reject", "queue":
+		return true
+	}
+
+	return false
+}
+
+// A recording holds a lease on its stream, renewed every third of leaseTTL
+// while it runs. The lease is exclusive, so only one recording at a time
+// writes to a stream. Leases are indexed by expiry in a sorted set, which
+// every process sweeps for streams whose writer went away without finishing
+// them. Those streams are marked as aborted, and the close is published to
+// their viewers.
+//
+// With leases disabled, recordings take no lease. Nothing keeps two writers
+// from recording to a stream at once, and a stream whose writer went away
+// without finishing it stays open, but no stream is ever locked by a lease
+// that's never given up.
+
+func (s *Stream) leaseKey() string { return s.key("lease:") }
+
+func leasesKey() string { return keyPrefix + "leases" }
+
+// acquire takes the lease on the stream, waiting for it to be released with
+// the "queue" writer-conflict policy.
+func (s *Stream) acquire() error {
+	s.lease = newLeaseToken()
+
+	var timeout <-chan time.Time
+	if writerConflict == "queue" {
+		timeout = time.After(writerQueue)
+	}
+
+	for {
+		err := s.take()
+		if err != ErrLeaseLost {
+			return err
+		} else if timeout == nil {
+			return ErrWriterConflict
+		}
+
+		select {
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		case <-timeout:
+			return ErrWriterConflict
+		case <-time.After(leaseRetry):
+		}
+	}
+}
+
+// renew extends the lease on the stream, or takes it again if it expired,
+// unless another writer took it over in the meantime.
+func (s *Stream) renew() error {
+	s.conn.Send("WATCH", s.leaseKey())
+
+	lease, err := redis.String(s.conn.Do("GET", s.leaseKey()))
+	if err == redis.ErrNil {
+		s.conn.Do("UNWATCH")
+		return s.take()
+	} else if err != nil {
+		s.conn.Do("UNWATCH")
+		return err
+	} else if lease != s.lease {
+		s.conn.Do("UNWATCH")
+		return ErrLeaseLost
+	}
+
+	s.conn.Send("MULTI")
+	s.conn.Send("SET", s.leaseKey(), s.lease, "PX", leaseMillis())
+	if reply, err := s.conn.Do("EXEC"); err != nil {
+		return err
+	} else if reply == nil {
+		return ErrLeaseLost
+	}
+
+	return s.index("ZADD", leaseExpiry(), s.Name)
+}
+
+// take takes the lease if no writer holds it. With leases disabled, there's
+// none to take.
+func (s *Stream) take() error {
+	if leaseTTL <= 0 {
+		return nil
+	}
+
+	reply, err := s.conn.Do("SET", s.leaseKey(), s.lease, "NX", "PX", leaseMillis())
+	if err != nil {
+		return err
+	} else if reply == nil {
+		return ErrLeaseLost
+	}
+
+	return s.index("ZADD", leaseExpiry(), s.Name)
+}
+
+// newLeaseToken returns a random lease token. A recording's token is handed
+// to its recorder, for resuming it.
+func newLeaseToken() string {
+	token := make([]byte, 16)
+	rand.Read(token)
+
+	return hex.EncodeToString(token)
+}
+
+func leaseMillis() int64 { return int64(leaseTTL / time.Millisecond) }
+
+func leaseExpiry() int64 {
+	return time.Now().Add(leaseTTL).UnixNano() / int64(time.Millisecond)
+}
+
+// heldLease watches the lease key, and reports whether it still holds the
+// stream's lease. A transaction that follows gives the lease up only if it's
+// held, so that it never removes the lease of a writer that took the stream
+// over, and fails if the lease changes before it runs.
+func (s *Stream) heldLease() (bool, error) {
+	s.conn.Send("WATCH", s.leaseKey())
+
+	lease, err := redis.String(s.conn.Do("GET", s.leaseKey()))
+	if err == redis.ErrNil {
+		return false, nil
+	} else if err != nil {
+		s.conn.Do("UNWATCH")
+		return false, err
+	}
+
+	return lease == s.lease, nil
+}
+
+// drop gives up the lease without changing the stream, for a writer that
+// failed to set it up.
+func (s *Stream) drop() {
+	if held, err := s.heldLease(); err == nil && held {
+		s.conn.Send("MULTI")
+		s.conn.Send("DEL", s.leaseKey())
+		s.conn.Do("EXEC")
+	} else if err == nil {
+		s.conn.Do("UNWATCH")
+	}
+
+	s.release()
+	s.close()
+}
+
+// release drops the stream from the lease index once it's finished or
+// deleted. Its lease key is removed along with the stream's other changes.
+func (s *Stream) release() error { return s.index("ZREM", s.Name) }
+
+func (s *Stream) index(cmd string, args ...interface{}) error {
+	if leaseTTL <= 0 || shards == nil {
+		return nil
+	}
+
+	conn := s.connTo(shards.shard(s.Name), leasesKey())
+	defer conn.Close()
+
+	_, err := conn.Do(cmd, append([]interface{}{leasesKey()}, args...)...)
+
+	return err
+}
+
+func sweepLeases() {
+	for range time.Tick(leaseTTL) {
+		for _, sh := range shards.shards {
+			sweep(sh)
+		}
+	}
+}
+
+// sweep aborts the streams on a shard whose leases have expired.
+func sweep(sh *shard) error {
+	conn := sh.servers.conn(leasesKey())
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	names, err := redis.Strings(conn.Do("ZRANGEBYSCORE", leasesKey(), "-inf", now))
+	conn.Close()
+
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		s := &Stream{Name: name, conn: sh.servers.get(name)}
+		err = s.expire()
+		s.conn.Close()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// expire marks the stream as aborted, unless its writer renewed the lease
+// or finished the stream in the meantime.
+func (s *Stream) expire() error {
+	_, size, err := s.snapshot()
+	if err != nil {
+		return err
+	}
+
+	s.conn.Send("WATCH", s.leaseKey(), s.stateKey())
+
+	lease, err := redis.Bool(s.conn.Do("EXISTS", s.leaseKey()))
+	if err != nil || lease {
+		s.conn.Do("UNWATCH")
+		return err
+	}
+
+	if state, err := s.getState(); err != nil && err != redis.ErrNil {
+		s.conn.Do("UNWATCH")
+		return err
+	} else if state == Opened {
+		s.conn.Send("MULTI")
+		s.conn.Send("SET", s.stateKey(), Aborted)
+		s.conn.Send("HSET", s.metaKey(), "finished", millis(time.Now()))
+		s.conn.Send("PUBLISH", s.streamKey(), message{Aborted, size, nil}.encode())
+
+		// The lease was renewed or the stream changed since it was checked.
+		if reply, err := s.conn.Do("EXEC"); err != nil || reply == nil {
+			return err
+		}
+
+		s.size = size
+		if err := s.announce("aborted"); err != nil {
+			return err
+		}
+	} else {
+		s.conn.Do("UNWATCH")
+	}
+
+	return s.release()
+}
@@ -0,0 +1,182 @@
+package stream
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/htee/hteed/Godeps/_workspace/src/code.google.com/p/go.net/context"
+)
+
+func TestSweepExpiredLeases(t *testing.T) {
+	defer func(ttl time.Duration, r *ring) { leaseTTL, shards = ttl, r }(leaseTTL, shards)
+	leaseTTL = time.Minute
+
+	conn := newMemConn()
+	sh := memShard("mem:6379", conn)
+	shards = newRing(sh)
+
+	live := &Stream{Name: "/test/live", conn: conn}
+	orphan := &Stream{Name: "/test/orphaned", conn: conn}
+
+	for _, s := range []*Stream{live, orphan} {
+		if err := s.renew(); err != nil {
+			t.Fatal(err)
+		} else if err := s.append([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The orphan's writer died, and its lease expired.
+	delete(conn.strings, orphan.leaseKey())
+	conn.zsets[leasesKey()][orphan.Name] = 0
+
+	if err := sweep(sh); err != nil {
+		t.Fatal(err)
+	}
+
+	if state, err := orphan.getState(); err != nil || state != Aborted {
+		t.Errorf("orphaned stream is in state %d, %v, want aborted", state, err)
+	}
+
+	messages := conn.messages[orphan.streamKey()]
+	if m, err := decodeMessage(messages[len(messages)-1]); err != nil || m.state != Aborted || m.offset != 5 {
+		t.Errorf("orphaned stream published %v, %v, want aborted at 5", m, err)
+	}
+
+	if state, err := live.getState(); err != nil || state != Opened {
+		t.Errorf("live stream is in state %d, %v, want opened", state, err)
+	}
+
+	if _, ok := conn.zsets[leasesKey()][orphan.Name]; ok {
+		t.Error("orphaned stream is still indexed")
+	}
+
+	if err := live.finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := conn.strings[live.leaseKey()]; ok || len(conn.zsets[leasesKey()]) != 0 {
+		t.Error("finished stream kept its lease")
+	}
+}
+
+func TestExclusiveWriter(t *testing.T) {
+	defer func(ttl time.Duration, policy string, queue time.Duration, r *ring) {
+		leaseTTL, writerConflict, writerQueue, shards = ttl, policy, queue, r
+	}(leaseTTL, writerConflict, writerQueue, shards)
+	leaseTTL, writerConflict, writerQueue = time.Minute, "reject", time.Second
+
+	conn := newMemConn()
+	shards = newRing(memShard("mem:6379", conn))
+
+	name := "/test/exclusive"
+
+	first, err := Open(context.Background(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(context.Background(), name); err != ErrWriterConflict {
+		t.Errorf("second writer opened the stream with %v, want ErrWriterConflict", err)
+	}
+
+	writerConflict = "queue"
+
+	opened := make(chan *Stream)
+	go func() {
+		second, err := Open(context.Background(), name)
+		if err != nil {
+			t.Error(err)
+		}
+		opened <- second
+	}()
+
+	if err := first.finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	second := <-opened
+	if second == nil {
+		return
+	}
+
+	if err := second.renew(); err != nil {
+		t.Errorf("queued writer can't renew its lease: %v", err)
+	}
+
+	if err := first.renew(); err != ErrLeaseLost {
+		t.Errorf("finished writer renewed the lease with %v, want ErrLeaseLost", err)
+	}
+}
+
+func TestDisabledLeases(t *testing.T) {
+	defer func(ttl time.Duration, policy string, r *ring) {
+		leaseTTL, writerConflict, shards = ttl, policy, r
+	}(leaseTTL, writerConflict, shards)
+	leaseTTL, writerConflict = 0, "reject"
+
+	conn := newMemConn()
+	shards = newRing(memShard("mem:6379", conn))
+
+	name := "/test/unleased"
+
+	// The first writer goes away without finishing the stream.
+	if _, err := Open(context.Background(), name); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := conn.strings[(&Stream{Name: name}).leaseKey()]; ok {
+		t.Error("writer took a lease with leases disabled")
+	}
+
+	if _, ok := conn.zsets[leasesKey()][name]; ok {
+		t.Error("disabled lease was indexed for sweeping")
+	}
+
+	s, err := Open(context.Background(), name)
+	if err != nil {
+		t.Fatalf("stream is locked after its writer went away: %v", err)
+	}
+
+	s.Record(strings.NewReader("hello"))
+	<-s.Done()
+
+	if s.Err != nil {
+		t.Fatal(s.Err)
+	}
+
+	if state, err := (&Stream{Name: name, conn: conn}).getState(); err != nil || state != Closed {
+		t.Errorf("stream is in state %d, %v, want closed", state, err)
+	}
+}
+
+func TestTakenOverLease(t *testing.T) {
+	defer func(ttl time.Duration, r *ring) { leaseTTL, shards = ttl, r }(leaseTTL, shards)
+	leaseTTL = time.Minute
+
+	conn := newMemConn()
+	shards = newRing(memShard("mem:6379", conn))
+
+	first, err := Open(context.Background(), "/test/taken")
+	if err != nil {
+		t.Fatal(err)
+	} else if err := first.append([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first writer's lease expired, and a second writer took it.
+	conn.strings[first.leaseKey()] = []byte("second")
+
+	if err := first.finish(); err != nil {
+		t.Fatal(err)
+	} else if lease := string(conn.strings[first.leaseKey()]); lease != "second" {
+		t.Errorf("finishing writer left lease %q, want the second writer's", lease)
+	}
+
+	if err := StreamDelete(context.Background(), first.Name); err != nil {
+		t.Fatal(err)
+	} else if lease := string(conn.strings[first.leaseKey()]); lease != "second" {
+		t.Errorf("deleting the stream left lease %q, want the second writer's", lease)
+	}
+}
@@ -0,0 +1,373 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/htee/hteed/Godeps/_workspace/src/github.com/garyburd/redigo/redis"
+)
+
+// A Marker names an offset of a stream, such as where its tests started.
+// Markers are kept in a sorted set scored by offset, and announced on the
+// stream's markers channel as they're added, for playback to emit them in
+// place.
+//
+// Recorders add markers in-band by writing markerPrefix, the marker's name
+// and a BEL character. The sequence is an operating system command that
+// terminals ignore, and is removed from the stored data.
+type Marker struct {
+	Name   string    `json:"name"`
+	Offset int64     `json:"offset"`
+	Time   time.Time `json:"time"`
+}
+
+var markerPrefix = []byte("\x1b]htee;marker=")
+
+const (
+	markerEnd     = '\a'
+	maxMarkerName = 256
+
+	// Appends are indexed by time at most once per timeIndexInterval, for
+	// markers placed by time.
+	timeIndexInterval = time.Second
+)
+
+func (s *Stream) markersKey() string { return s.key("markers:") }
+
+func (s *Stream) markersChannel() string { return s.key("markers:events:") }
+
+func (s *Stream) timesKey() string { return s.key("times:") }
+
+// Mark adds the marker to the named stream. A marker with a negative offset
+// is placed at the data appended around its time, or at the end of the
+// stream if it has no time either. A marker without a time is stamped with
+// the current time.
+func Mark(name string, m Marker) (Marker, error) {
+	s := &Stream{Name: name, conn: shards.shard(name).servers.get(name)}
+	defer s.conn.Close()
+
+	if exists, err := redis.Bool(s.conn.Do("EXISTS", s.stateKey())); err != nil {
+		return m, err
+	} else if !exists {
+		return m, ErrNoStream
+	}
+
+	if m.Offset < 0 {
+		var err error
+		if m.Time.IsZero() {
+			_, m.Offset, err = s.snapshot()
+		} else {
+			m.Offset, err = s.offsetAt(m.Time)
+		}
+
+		if err != nil {
+			return m, err
+		}
+	}
+
+	if m.Time.IsZero() {
+		m.Time = time.Now()
+	}
+	m.Time = fromMillis(millis(m.Time))
+
+	return m, s.mark(m)
+}
+
+func (s *Stream) mark(m Marker) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	s.conn.Send("MULTI")
+	s.conn.Send("ZADD", s.markersKey(), m.Offset, data)
+	s.conn.Send("PUBLISH", s.markersChannel(), data)
+	_, err = s.conn.Do("EXEC")
+
+	return err
+}
+
+// offsetAt returns the offset of the last data indexed at or before the time.
+func (s *Stream) offsetAt(t time.Time) (int64, error) {
+	reply, err := redis.Strings(s.conn.Do("ZREVRANGEBYSCORE", s.timesKey(), millis(t), "-inf", "WITHSCORES", "LIMIT", 0, 1))
+	if err != nil || len(reply) == 0 {
+		return 0, err
+	}
+
+	return strconv.ParseInt(reply[0], 10, 64)
+}
+
+// Markers returns the named stream's markers, by offset.
+func Markers(name string) ([]Marker, error) {
+	conn := shards.shard(name).servers.get(name)
+	defer conn.Close()
+
+	return (&Stream{Name: name, conn: conn}).markers()
+}
+
+func (s *Stream) markers() ([]Marker, error) {
+	reply, err := redis.Values(s.conn.Do("ZRANGE", s.markersKey(), 0, -1))
+	if err != nil {
+		return nil, err
+	}
+
+	markers := make([]Marker, 0, len(reply))
+	for _, data := range reply {
+		var m Marker
+		if err := json.Unmarshal(data.([]byte), &m); err != nil {
+			return nil, err
+		}
+		markers = append(markers, m)
+	}
+
+	sort.Stable(byOffset(markers))
+
+	return markers, nil
+}
+
+type byOffset []Marker
+
+func (m byOffset) Len() int           { return len(m) }
+func (m byOffset) Less(i, j int) bool { return m[i].Offset < m[j].Offset }
+func (m byOffset) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+
+// queue batches recorded data, taking out the in-band markers.
+func (s *Stream) queue(buf []byte) {
+	data, marks := s.scanner.scan(buf)
+
+	for _, mark := range marks {
+		offset := s.end() + int64(len(s.batch)+mark.pos)
+		s.marks = append(s.marks, Marker{mark.name, offset, fromMillis(millis(time.Now()))})
+	}
+
+	s.batchData(data)
+}
+
+// queueHeld batches the data held back by the redactor and by the marker
+// scanner.
+func (s *Stream) queueHeld() {
+	s.queue(s.redactor.flush())
+	s.batchData(s.scanner.flush())
+}
+
+// storeMarks adds the in-band markers taken out of the recorded data. While
+// the stream is spooled they're kept until its spool is replayed.
+func (s *Stream) storeMarks() error {
+	if s.spool != nil {
+		return nil
+	}
+
+	for len(s.marks) > 0 {
+		if err := s.mark(s.marks[0]); err != nil {
+			return err
+		}
+		s.marks = s.marks[1:]
+	}
+
+	return nil
+}
+
+// A markerScanner takes in-band markers out of recorded data. A marker may
+// be split across the chunks passed to scan, so a trailing part of one is
+// held back until more data arrives or the scanner is flushed.
+type markerScanner struct {
+	held []byte
+}
+
+type inband struct {
+	name string
+	pos  int // position in the data returned by scan
+}
+
+func (sc *markerScanner) scan(buf []byte) ([]byte, []inband) {
+	data := buf
+	if len(sc.held) > 0 {
+		data = append(sc.held, buf...)
+		sc.held = nil
+	}
+
+	if len(data) == 0 {
+		return data, nil
+	}
+
+	var out []byte
+	var marks []inband
+
+	for {
+		i := bytes.Index(data, markerPrefix)
+		if i < 0 {
+			n := partialPrefix(data)
+			sc.held = append([]byte(nil), data[len(data)-n:]...)
+
+			if marks == nil {
+				return data[:len(data)-n], nil
+			}
+
+			return append(out, data[:len(data)-n]...), marks
+		}
+
+		out = append(out, data[:i]...)
+		rest := data[i+len(markerPrefix):]
+
+		j := bytes.IndexByte(rest, markerEnd)
+		if j < 0 && len(rest) <= maxMarkerName {
+			sc.held = append([]byte(nil), data[i:]...)
+			return out, marks
+		} else if j < 0 || j > maxMarkerName {
+			// Not a marker after all.
+			out = append(out, data[i])
+			data = data[i+1:]
+			continue
+		}
+
+		marks = append(marks, inband{string(rest[:j]), len(out)})
+		data = rest[j+1:]
+	}
+}
+
+// partialPrefix returns the length of the longest suffix of data that begins
+// a marker.
+func partialPrefix(data []byte) int {
+	n := len(markerPrefix) - 1
+	if n > len(data) {
+		n = len(data)
+	}
+
+	for ; n > 0; n-- {
+		if bytes.HasPrefix(markerPrefix, data[len(data)-n:]) {
+			return n
+		}
+	}
+
+	return 0
+}
+
+func (sc *markerScanner) buffered() bool { return len(sc.held) > 0 }
+
+// flush returns the data held back.
+func (sc *markerScanner) flush() []byte {
+	held := sc.held
+	sc.held = nil
+
+	return held
+}
+
+// A markerWriter emits the stream's markers as "marker" events in place, as
+// the data written through it reaches their offsets. Markers that arrive
+// after their offset was played back are emitted as soon as they arrive.
+type markerWriter struct {
+	EventWriter
+	pending []Marker
+	seen    map[markerID]bool
+	pos     int64 // offset of the next byte played back
+}
+
+type markerID struct {
+	name   string
+	offset int64
+}
+
+func newMarkerWriter(writer EventWriter) *markerWriter {
+	return &markerWriter{EventWriter: writer, seen: make(map[markerID]bool)}
+}
+
+// add queues the markers not seen yet, and emits the ones that are due.
+func (w *markerWriter) add(markers ...Marker) error {
+	for _, m := range markers {
+		id := markerID{m.Name, m.Offset}
+		if w.seen[id] {
+			continue
+		}
+		w.seen[id] = true
+		w.pending = append(w.pending, m)
+	}
+
+	sort.Stable(byOffset(w.pending))
+
+	return w.due()
+}
+
+// due emits the markers up to the playback offset.
+func (w *markerWriter) due() error {
+	for len(w.pending) > 0 && w.pending[0].Offset <= w.pos {
+		if err := w.EventWriter.WriteEvent("marker", w.pending[0]); err != nil {
+			return err
+		}
+		w.pending = w.pending[1:]
+	}
+
+	return nil
+}
+
+func (w *markerWriter) Write(p []byte) (int, error) {
+	written := 0
+
+	for len(p) > 0 {
+		if err := w.due(); err != nil {
+			return written, err
+		}
+
+		n := len(p)
+		if len(w.pending) > 0 && w.pending[0].Offset < w.pos+int64(n) {
+			n = int(w.pending[0].Offset - w.pos)
+		}
+
+		n, err := w.EventWriter.Write(p[:n])
+		written += n
+		w.pos += int64(n)
+		if err != nil {
+			return written, err
+		}
+
+		p = p[n:]
+	}
+
+	return written, w.due()
+}
+
+func (w *markerWriter) WriteEvent(event string, data interface{}) error {
+	if err := w.EventWriter.WriteEvent(event, data); err != nil {
+		return err
+	}
+
+	if gap, ok := data.(Gap); ok {
+		w.pos = gap.Offset + gap.Length
+	}
+
+	return w.due()
+}
+
+// flush emits the markers left once the stream has ended.
+func (w *markerWriter) flush() error {
+	for _, m := range w.pending {
+		if err := w.EventWriter.WriteEvent("marker", m); err != nil {
+			return err
+		}
+	}
+	w.pending = nil
+
+	return nil
+}
+
+// receive queues the markers published on the stream's markers channel.
+func (w *markerWriter) receive(feed *viewer) error {
+	for _, v := range feed.take() {
+		if v.err != nil {
+			return v.err
+		}
+
+		var m Marker
+		if err := json.Unmarshal(v.buf, &m); err != nil {
+			return err
+		}
+
+		if err := w.add(m); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,137 @@
+package stream
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMarkerScanner(t *testing.T) {
+	var sc markerScanner
+
+	chunks := []string{
+		"make\n\x1b]htee;mark", "er=tests started\a", "ok\n\x1b",
+		"]htee;marker=deploy\aESC\x1b[0m", "\x1b]htee;marker=",
+	}
+
+	var out []byte
+	var marks []inband
+	for _, chunk := range chunks {
+		data, found := sc.scan([]byte(chunk))
+		for _, m := range found {
+			marks = append(marks, inband{m.name, len(out) + m.pos})
+		}
+		out = append(out, data...)
+	}
+
+	if !sc.buffered() {
+		t.Error("scanner didn't hold back the unfinished marker")
+	}
+	out = append(out, sc.flush()...)
+
+	if want := "make\nok\nESC\x1b[0m\x1b]htee;marker="; string(out) != want {
+		t.Errorf("scanned data is %q, want %q", out, want)
+	}
+
+	want := []inband{{"tests started", 5}, {"deploy", 8}}
+	if !reflect.DeepEqual(marks, want) {
+		t.Errorf("scanned markers are %+v, want %+v", marks, want)
+	}
+}
+
+func TestMark(t *testing.T) {
+	defer func(r *ring) { shards = r }(shards)
+
+	conn := newMemConn()
+	shards = newRing(memShard("mem:6379", conn))
+
+	name := "/alice/deploy"
+	if _, err := Mark(name, Marker{Name: "early", Offset: -1}); err != ErrNoStream {
+		t.Errorf("marked a missing stream with %v, want ErrNoStream", err)
+	}
+
+	s := &Stream{Name: name, conn: conn}
+	s.queue([]byte("build\n\x1b]htee;marker=built\a"))
+	if err := s.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The time index is added to by the next append.
+	s.indexed = 0
+	if err := s.append([]byte("deploy\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Mark(name, Marker{Name: "end", Offset: -1}); err != nil {
+		t.Error(err)
+	}
+	if _, err := Mark(name, Marker{Name: "deploying", Offset: -1, Time: time.Now().Add(time.Hour)}); err != nil {
+		t.Error(err)
+	}
+	if _, err := Mark(name, Marker{Name: "queued", Offset: -1, Time: time.Unix(1, 0)}); err != nil {
+		t.Error(err)
+	}
+	if _, err := Mark(name, Marker{Name: "d", Offset: 7}); err != nil {
+		t.Error(err)
+	}
+
+	markers, err := Markers(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, m := range markers {
+		got = append(got, fmt.Sprintf("%s@%d", m.Name, m.Offset))
+	}
+
+	if want := []string{"queued@0", "built@6", "deploying@6", "d@7", "end@13"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("markers are %v, want %v", got, want)
+	}
+
+	if err := s.delete(); err != nil {
+		t.Fatal(err)
+	} else if len(conn.zsets[s.markersKey()]) != 0 || len(conn.zsets[s.timesKey()]) != 0 {
+		t.Error("delete left markers behind")
+	}
+}
+
+func TestMarkerWriter(t *testing.T) {
+	events := make(eventRecorder, 16)
+	w := newMarkerWriter(events)
+
+	start, mid := Marker{Name: "start"}, Marker{Name: "mid", Offset: 3}
+	if err := w.add(start, mid, Marker{Name: "end", Offset: 12}); err != nil {
+		t.Fatal(err)
+	}
+	events.expect(t, "marker", start)
+
+	if _, err := w.Write([]byte("abcdef")); err != nil {
+		t.Fatal(err)
+	}
+	events.expect(t, "write", "abc")
+	events.expect(t, "marker", mid)
+	events.expect(t, "write", "def")
+
+	// A marker behind the playback is emitted right away, once.
+	late := Marker{Name: "late", Offset: 1}
+	if err := w.add(late, mid); err != nil {
+		t.Fatal(err)
+	}
+	events.expect(t, "marker", late)
+
+	if err := w.WriteEvent("gap", Gap{6, 4}); err != nil {
+		t.Fatal(err)
+	}
+	events.expect(t, "gap", Gap{6, 4})
+
+	if err := w.flush(); err != nil {
+		t.Fatal(err)
+	}
+	events.expect(t, "marker", Marker{Name: "end", Offset: 12})
+
+	if len(events) != 0 {
+		t.Errorf("%d unexpected events", len(events))
+	}
+}
@@ -0,0 +1,197 @@
+package stream
+
+import (
+	"encoding/json"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/htee/hteed/Godeps/_workspace/src/code.google.com/p/go.net/context"
+)
+
+// A Chunk is stream data in a multiplexed view.
+type Chunk struct {
+	Name string `json:"name"`
+	Data string `json:"data"`
+}
+
+// A StreamGap is data skipped from one stream of a multiplexed view.
+type StreamGap struct {
+	Name string `json:"name"`
+	Gap
+}
+
+// A StreamEnd ends one stream of a multiplexed view.
+type StreamEnd struct {
+	Name  string `json:"name"`
+	Error string `json:"error,omitempty"`
+}
+
+// A muxed is queued data from one stream of a multiplexed view.
+type muxed struct {
+	name string
+	bufErr
+}
+
+// FollowOwner writes the data of every live stream of the owner whose name
+// matches the glob pattern, or all of them if the pattern is empty, to the
+// writer as events tagged with the stream name. Streams opened or reopened
+// later are followed as they're announced, reopened ones from where they
+// were reopened. Each stream's data is written as "data"
+// events, skipped data as "gap" events, and its end as an "end" event.
+func FollowOwner(ctx context.Context, owner, pattern string, writer EventWriter) *Stream {
+	s := &Stream{
+		ctx:  ctx,
+		Name: owner,
+		done: make(chan struct{}),
+	}
+
+	// The feed is joined first, so that streams opened while the live ones
+	// are listed aren't missed.
+	s.viewer = shards.shard(ownerKey(owner)).hub.listen(eventsKey(owner))
+
+	go streamMux(s, owner, pattern, writer)
+
+	return s
+}
+
+func streamMux(s *Stream, owner, pattern string, writer EventWriter) {
+	defer s.close()
+
+	queue := make(chan muxed)
+	followed := make(map[string]*viewer)
+	reopened := make(map[string]int64) // streams reopened before their end was written
+
+	defer func() {
+		for _, v := range followed {
+			v.leave()
+		}
+	}()
+
+	follow := func(name string, offset int64) {
+		if _, ok := followed[name]; ok || !matchName(owner, pattern, name) {
+			return
+		}
+
+		v := shards.shard(name).hub.joinAt(name, offset)
+		followed[name] = v
+
+		go forward(s, name, v, queue)
+	}
+
+	for opts := (ListOptions{Limit: maxListLimit, States: []State{Opened}}); ; {
+		infos, more, err := List(owner, opts)
+		if err != nil {
+			s.Err = err
+			return
+		}
+
+		for _, info := range infos {
+			follow(info.Name, 0)
+		}
+
+		if !more {
+			break
+		}
+		opts.Before, opts.Last = infos[len(infos)-1].Created, infos[len(infos)-1].Name
+	}
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-s.done:
+			return
+		case <-s.viewer.ready:
+			for _, v := range s.viewer.take() {
+				if v.err != nil {
+					s.Err = v.err
+					return
+				}
+
+				var event Event
+				if err := json.Unmarshal(v.buf, &event); err != nil {
+					s.Err = err
+					return
+				}
+
+				switch event.Type {
+				case "opened":
+					follow(event.Name, 0)
+				case "reopened":
+					if _, ok := followed[event.Name]; ok {
+						reopened[event.Name] = event.Size
+					}
+					follow(event.Name, event.Size)
+				}
+			}
+		case m := <-queue:
+			if err := writeMuxed(writer, m); err != nil {
+				s.Err = err
+				return
+			}
+
+			// The stream ended, and is followed again if it's reopened.
+			if _, gap := m.err.(Gap); m.err != nil && !gap {
+				followed[m.name].leave()
+				delete(followed, m.name)
+
+				if offset, ok := reopened[m.name]; ok {
+					delete(reopened, m.name)
+					follow(m.name, offset)
+				}
+			}
+		}
+	}
+}
+
+// forward queues the data of one stream of a multiplexed view until the
+// stream ends or the view is done.
+func forward(s *Stream, name string, v *viewer, queue chan<- muxed) {
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-v.ready:
+			for _, be := range v.take() {
+				select {
+				case queue <- muxed{name, be}:
+				case <-s.done:
+					return
+				}
+
+				if _, gap := be.err.(Gap); be.err != nil && !gap {
+					return
+				}
+			}
+		}
+	}
+}
+
+func writeMuxed(writer EventWriter, m muxed) error {
+	switch err := m.err.(type) {
+	case nil:
+		return writer.WriteEvent("data", Chunk{m.name, string(m.buf)})
+	case Gap:
+		return writer.WriteEvent("gap", StreamGap{m.name, err})
+	default:
+		end := StreamEnd{Name: m.name}
+		if err != io.EOF {
+			end.Error = err.Error()
+		}
+
+		return writer.WriteEvent("end", end)
+	}
+}
+
+// matchName reports whether the owner's stream name matches the glob
+// pattern, which is matched against the name without its owner.
+func matchName(owner, pattern, name string) bool {
+	if pattern == "" {
+		return true
+	}
+
+	ok, _ := path.Match(pattern, strings.TrimPrefix(name, "/"+owner+"/"))
+
+	return ok
+}
@@ -0,0 +1,122 @@
+package stream
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/htee/hteed/Godeps/_workspace/src/code.google.com/p/go.net/context"
+	"github.com/htee/hteed/Godeps/_workspace/src/github.com/garyburd/redigo/redis"
+)
+
+func TestFollowOwner(t *testing.T) {
+	defer func(r *ring) { shards = r }(shards)
+
+	conn := newMemConn()
+	rConn, nConn := redisPipeConn()
+
+	p := &redis.Pool{Dial: func() (redis.Conn, error) { return conn, nil }}
+	shards = newRing(newShard("mem:6379", server{p}, func() (redis.Conn, error) { return rConn, nil }))
+
+	go confirmSubscriptions(nConn)
+
+	for _, name := range []string{"/alice/build-1", "/alice/deploy", "/alice/build-0", "/bob/build-2"} {
+		s := &Stream{Name: name, conn: conn}
+		if err := s.append([]byte("hi")); err != nil {
+			t.Fatal(err)
+		}
+
+		if name == "/alice/build-0" {
+			if err := s.finish(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	events := make(eventRecorder, 16)
+	mux := FollowOwner(context.Background(), "alice", "build-*", events)
+	defer mux.Cancel()
+
+	events.expect(t, "data", Chunk{"/alice/build-1", "hi"})
+
+	// A stream opened after the view started.
+	s := &Stream{Name: "/alice/build-3", conn: conn}
+	if err := s.append([]byte("yo")); err != nil {
+		t.Fatal(err)
+	}
+
+	opened, _ := json.Marshal(Event{Type: "opened", Name: s.Name, Size: 2})
+	writeFeed(nConn, eventsKey("alice"), opened)
+
+	events.expect(t, "data", Chunk{"/alice/build-3", "yo"})
+
+	channel := (&Stream{Name: "/alice/build-1"}).streamKey()
+	writeFeed(nConn, channel, message{Opened, 2, []byte("!")}.encode())
+	writeFeed(nConn, channel, message{Closed, 3, nil}.encode())
+
+	events.expect(t, "data", Chunk{"/alice/build-1", "!"})
+	events.expect(t, "end", StreamEnd{Name: "/alice/build-1"})
+
+	// The ended stream is reopened, and followed from there.
+	s = &Stream{Name: "/alice/build-1", conn: conn, size: 2}
+	if err := s.append([]byte("??")); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, _ := json.Marshal(Event{Type: "reopened", Name: s.Name, Size: 2})
+	writeFeed(nConn, eventsKey("alice"), reopened)
+
+	events.expect(t, "data", Chunk{"/alice/build-1", "??"})
+}
+
+// confirmSubscriptions answers every SUBSCRIBE sent to the subscriber
+// connection.
+func confirmSubscriptions(nConn net.Conn) {
+	c := redis.NewConn(nConn, 0, 0)
+
+	for {
+		cmd, err := redis.Strings(c.Receive())
+		if err != nil {
+			return
+		}
+
+		if len(cmd) == 2 && cmd[0] == "SUBSCRIBE" {
+			nConn.Write([]byte(respSubscribed(cmd[1])))
+		}
+	}
+}
+
+func writeFeed(nConn net.Conn, channel string, data []byte) {
+	nConn.Write([]byte(fmt.Sprintf("*3\r\n$7\r\nmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n",
+		len(channel), channel, len(data), data)))
+}
+
+// eventRecorder is an EventWriter queueing the events written to it. Data
+// written to it is queued as "write" events.
+type eventRecorder chan [2]interface{}
+
+func (r eventRecorder) Write(p []byte) (int, error) {
+	r <- [2]interface{}{"write", string(p)}
+
+	return len(p), nil
+}
+
+func (r eventRecorder) WriteEvent(event string, data interface{}) error {
+	r <- [2]interface{}{event, data}
+
+	return nil
+}
+
+func (r eventRecorder) expect(t *testing.T, event string, data interface{}) {
+	select {
+	case got := <-r:
+		if got[0] != event || !reflect.DeepEqual(got[1], data) {
+			t.Errorf("wrote %s %+v, want %s %+v", got[0], got[1], event, data)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for %s %+v", event, data)
+	}
+}
@@ -2,80 +2,143 @@ package stream
 
 import (
 	"errors"
+	"fmt"
 	"io"
 
 	"github.com/htee/hteed/Godeps/_workspace/src/code.google.com/p/go.net/context"
-	"github.com/htee/hteed/Godeps/_workspace/src/github.com/garyburd/redigo/redis"
 )
 
+var (
+	viewerBuffer int
+	slowViewer   string
+	snapshotPage int
+
+	ErrSlowViewer = errors.New("Viewer fell too far behind the stream")
+)
+
+const (
+	defaultViewerBuffer = 1 << 20
+	defaultSnapshotPage = 256 << 10
+)
+
+// An EventWriter is a playback writer that can also carry events alongside
+// the stream data.
+type EventWriter interface {
+	io.Writer
+	WriteEvent(event string, data interface{}) error
+}
+
+// A Gap is data that was skipped because the viewer fell too far behind a
+// live stream.
+type Gap struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+func (g Gap) Error() string {
+	return fmt.Sprintf("Skipped %d bytes at offset %d", g.Length, g.Offset)
+}
+
+func validSlowViewerPolicy(policy string) bool {
+	switch policy {
+	case "disconnect", "resync", "gap":
+		return true
+	}
+
+	return false
+}
+
+// Out plays the named stream back to the writer, following it while it's
+// open. When the writer is an EventWriter, the stream's markers are written
+// as "marker" events in place.
 func Out(ctx context.Context, name string, writer io.Writer) *Stream {
-	s := newStream(ctx, name)
+	s := outStream(ctx, name, writer)
 
 	go streamOut(s, writer)
 
 	return s
 }
 
+func outStream(ctx context.Context, name string, writer io.Writer) *Stream {
+	s := &Stream{
+		ctx:  ctx,
+		Name: name,
+		done: make(chan struct{}),
+	}
+	s.viewer = shards.shard(name).hub.join(name)
+
+	// The markers are listened to before they're loaded, so that none are
+	// missed.
+	if _, ok := writer.(EventWriter); ok {
+		s.markerFeed = shards.shard(name).hub.listen(s.markersChannel())
+	}
+
+	return s
+}
+
 func streamOut(s *Stream, writer io.Writer) {
 	defer s.close()
 
-	bufErrChan := make(chan bufErr)
+	var marks *markerWriter
+	var marked <-chan struct{}
+	if ew, ok := writer.(EventWriter); ok && s.markerFeed != nil {
+		markers, err := Markers(s.Name)
+		if err != nil {
+			s.Err = err
+			return
+		}
 
-	go subscribe(s, bufErrChan)
+		marks = newMarkerWriter(ew)
+		if err := marks.add(markers...); err != nil {
+			s.Err = err
+			return
+		}
+
+		writer, marked = marks, s.markerFeed.ready
+	}
 
 	for {
 		select {
 		case <-s.ctx.Done():
 			return
-		case v, ok := <-bufErrChan:
-			if v.err == io.EOF || !ok {
-				return
-			} else if v.err != nil {
-				s.Err = v.err
+		case <-s.done:
+			return
+		case <-marked:
+			if err := marks.receive(s.markerFeed); err != nil {
+				s.Err = err
 				return
-			} else {
-				if _, err := writer.Write(v.buf); err != nil {
-					s.Err = err
+			}
+		case <-s.viewer.ready:
+			for _, v := range s.viewer.take() {
+				if v.err == io.EOF {
+					if marks != nil {
+						s.Err = marks.flush()
+					}
+					return
+				} else if gap, ok := v.err.(Gap); ok {
+					if err := writeGap(writer, gap); err != nil {
+						s.Err = err
+						return
+					}
+				} else if v.err != nil {
+					s.Err = v.err
 					return
+				} else {
+					if _, err := writer.Write(v.buf); err != nil {
+						s.Err = err
+						return
+					}
 				}
 			}
 		}
 	}
 }
 
-func subscribe(s *Stream, bufErrChan chan<- bufErr) {
-	defer close(bufErrChan)
-
-	state, buf, err := s.subscribe()
-
-	bufErrChan <- bufErr{buf, err}
-
-	if err == nil && state == Opened {
-		streamChannel(s, bufErrChan)
+func writeGap(writer io.Writer, gap Gap) error {
+	if ew, ok := writer.(EventWriter); ok {
+		return ew.WriteEvent("gap", gap)
 	}
-}
 
-func streamChannel(s *Stream, bufErrChan chan<- bufErr) {
-	psc := redis.PubSubConn{s.conn}
-
-	for {
-		switch v := psc.Receive().(type) {
-		case redis.Message:
-			state, buf := State(v.Data[0]), v.Data[1:]
-
-			if state == Closed {
-				return
-			} else {
-				bufErrChan <- bufErr{buf, nil}
-			}
-		case error:
-			bufErrChan <- bufErr{nil, error(v)}
-
-			return
-		default:
-			bufErrChan <- bufErr{nil, errors.New("Unrecognized redis message")}
-
-			return
-		}
-	}
+	_, err := fmt.Fprintf(writer, "\n[%d bytes skipped]\n", gap.Length)
+	return err
 }
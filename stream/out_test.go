@@ -13,15 +13,22 @@ func TestCancelOut(t *testing.T) {
 	_, w := io.Pipe()
 	rConn, nConn := redisPipeConn()
 
+	h := newHub(func() (redis.Conn, error) { return rConn, nil }, nil)
+
 	s := &Stream{
-		conn: rConn,
 		ctx:  context.Background(),
 		Name: "canceled-out-stream",
 		done: make(chan struct{}),
 	}
+	s.viewer = h.join(s.Name)
 
 	go streamOut(s, w)
 
+	// Wait for the SUBSCRIBE on the shared connection.
+	if _, err := nConn.Read(make([]byte, 64)); err != nil {
+		t.Error(err)
+	}
+
 	s.Cancel()
 
 	if s.Err != nil {
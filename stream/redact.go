@@ -0,0 +1,184 @@
+package stream
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/htee/hteed/Godeps/_workspace/src/code.google.com/p/go.net/context"
+)
+
+var (
+	redactPatterns []string
+	redactWindow   int
+
+	redactedText = []byte("[REDACTED]")
+
+	// knownTokens match credential formats that are redacted when the
+	// redact-tokens option is set.
+	knownTokens = []string{
+		`AKIA[0-9A-Z]{16}`,                                              // AWS access key ID
+		`gh[pousr]_[0-9A-Za-z]{36,255}`,                                 // GitHub token
+		`github_pat_[0-9A-Za-z_]{22,255}`,                               // GitHub fine-grained token
+		`glpat-[0-9A-Za-z_\-]{20,}`,                                     // GitLab personal access token
+		`xox[abposr]-[0-9A-Za-z\-]{10,250}`,                             // Slack token
+		`AIza[0-9A-Za-z_\-]{35}`,                                        // Google API key
+		`[rs]k_live_[0-9A-Za-z]{24,99}`,                                 // Stripe secret key
+		`-----BEGIN [A-Z ]*PRIVATE KEY-----`,                            // PEM private key header
+		`eyJ[0-9A-Za-z_\-]{8,}\.eyJ[0-9A-Za-z_\-]{8,}\.[0-9A-Za-z_\-]+`, // JWT
+	}
+)
+
+const (
+	defaultRedactWindow = 256
+	redactIdleFlush     = time.Second
+)
+
+type redactKey int
+
+const redactValuesKey redactKey = 0
+
+// WithRedactions returns a copy of ctx carrying literal values that are
+// scrubbed from streams recorded with it, in addition to the configured
+// redaction patterns.
+func WithRedactions(ctx context.Context, values []string) context.Context {
+	return context.WithValue(ctx, redactValuesKey, values)
+}
+
+func redactions(ctx context.Context) []string {
+	values, _ := ctx.Value(redactValuesKey).([]string)
+	return values
+}
+
+func compileRedactPatterns(patterns []string, tokens bool) ([]string, error) {
+	if tokens {
+		patterns = append(patterns, knownTokens...)
+	}
+
+	for _, pattern := range patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return nil, err
+		}
+	}
+
+	return patterns, nil
+}
+
+// A redactor scrubs secrets from data before it is stored. Matches may span
+// the chunks passed to redact, so the last window bytes seen are held back
+// until more data arrives or the redactor is flushed. Secrets longer than the
+// window may be missed if they are split across chunks.
+type redactor struct {
+	re      *regexp.Regexp
+	window  int
+	pending []byte
+}
+
+func newRedactor(values []string) *redactor {
+	alts := make([]string, 0, len(redactPatterns)+len(values))
+
+	// Longer literals first so that a value containing another one is
+	// redacted whole.
+	literals := make([]string, 0, len(values))
+	for _, value := range values {
+		if value != "" {
+			literals = append(literals, value)
+		}
+	}
+	sort.Sort(byLength(literals))
+
+	for _, literal := range literals {
+		alts = append(alts, "(?:"+regexp.QuoteMeta(literal)+")")
+	}
+
+	for _, pattern := range redactPatterns {
+		alts = append(alts, "(?:"+pattern+")")
+	}
+
+	if len(alts) == 0 {
+		return nil
+	}
+
+	window := redactWindow
+	for _, literal := range literals {
+		if len(literal) > window {
+			window = len(literal)
+		}
+	}
+
+	return &redactor{
+		re:     regexp.MustCompile(strings.Join(alts, "|")),
+		window: window,
+	}
+}
+
+// redact returns the redacted data that can safely be stored after p has
+// been read. A nil redactor returns p unchanged.
+func (r *redactor) redact(p []byte) []byte {
+	if r == nil {
+		return p
+	}
+
+	buf := append(r.pending, p...)
+
+	cut := len(buf) - r.window
+	if cut <= 0 {
+		r.pending = buf
+		return nil
+	}
+
+	matches := r.re.FindAllIndex(buf, -1)
+	for _, m := range matches {
+		if m[0] < cut && m[1] > cut {
+			cut = m[0]
+			break
+		}
+	}
+
+	out := make([]byte, 0, cut)
+	last := 0
+	for _, m := range matches {
+		if m[1] > cut {
+			break
+		}
+
+		out = append(out, buf[last:m[0]]...)
+		out = append(out, redactedText...)
+		last = m[1]
+	}
+	out = append(out, buf[last:cut]...)
+
+	r.pending = append([]byte(nil), buf[cut:]...)
+
+	return out
+}
+
+// flush returns the redacted data held back by previous calls to redact.
+func (r *redactor) flush() []byte {
+	if r == nil || len(r.pending) == 0 {
+		return nil
+	}
+
+	out := r.re.ReplaceAllLiteral(r.pending, redactedText)
+	r.pending = nil
+
+	return out
+}
+
+func (r *redactor) buffered() bool { return r != nil && len(r.pending) > 0 }
+
+// held returns the data held back by previous calls to redact, unredacted.
+func (r *redactor) held() []byte {
+	if r == nil {
+		return nil
+	}
+
+	return r.pending
+}
+
+type byLength []string
+
+func (s byLength) Len() int           { return len(s) }
+func (s byLength) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byLength) Less(i, j int) bool { return len(s[i]) > len(s[j]) }
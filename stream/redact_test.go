@@ -0,0 +1,57 @@
+package stream
+
+import "testing"
+
+func TestRedactAcrossChunks(t *testing.T) {
+	redactPatterns, redactWindow = []string{`AKIA[0-9A-Z]{16}`}, 32
+	defer func() { redactPatterns, redactWindow = nil, 0 }()
+
+	r := newRedactor([]string{"hunter2"})
+
+	chunks := []string{
+		"key=AKIAABCD", "EFGHIJKLMNOP and pass",
+		"word=hun", "ter2", " done\n",
+	}
+
+	var out []byte
+	for _, chunk := range chunks {
+		out = append(out, r.redact([]byte(chunk))...)
+	}
+	out = append(out, r.flush()...)
+
+	want := "key=[REDACTED] and password=[REDACTED] done\n"
+	if string(out) != want {
+		t.Errorf("redacted data is %q, want %q", out, want)
+	}
+}
+
+func TestRedactHoldsWindow(t *testing.T) {
+	redactPatterns, redactWindow = []string{`secret`}, 8
+	defer func() { redactPatterns, redactWindow = nil, 0 }()
+
+	r := newRedactor(nil)
+
+	if out := r.redact([]byte("0123456789secr")); string(out) != "012345" {
+		t.Errorf("released data is %q, want %q", out, "012345")
+	}
+
+	if out := r.redact([]byte("et!")); string(out) != "678" {
+		t.Errorf("released data is %q, want %q", out, "678")
+	}
+
+	if out := r.flush(); string(out) != "9[REDACTED]!" {
+		t.Errorf("flushed data is %q, want %q", out, "9[REDACTED]!")
+	}
+}
+
+func TestNilRedactor(t *testing.T) {
+	var r *redactor
+
+	if out := r.redact([]byte("abc")); string(out) != "abc" {
+		t.Errorf("nil redactor returned %q, want %q", out, "abc")
+	}
+
+	if r.flush() != nil || r.buffered() {
+		t.Error("nil redactor holds data")
+	}
+}
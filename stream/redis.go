@@ -0,0 +1,421 @@
+package stream
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/htee/hteed/Godeps/_workspace/src/github.com/garyburd/redigo/redis"
+	"github.com/htee/hteed/config"
+)
+
+var (
+	retries    int
+	retryDelay = backoff(defaultRedisRetryDelay)
+)
+
+const (
+	defaultRedisMaxIdle        = 16
+	defaultRedisIdleTimeout    = 240 * time.Second
+	defaultRedisConnectTimeout = 10 * time.Second
+	defaultRedisPoolTimeout    = 5 * time.Second
+
+	defaultRedisRetries    = 10
+	defaultRedisRetryDelay = 100 * time.Millisecond
+	maxRedisRetryDelay     = 5 * time.Second
+)
+
+// A dialer opens connections to a redis server. The server is addressed by a
+// bare host:port, or by a redis:// or rediss:// (TLS) URL of the form
+// redis://[[user]:password@]host:port[/db].
+type dialer struct {
+	address  string
+	username string
+	password string
+	db       int
+	tls      *tls.Config
+
+	connectTimeout time.Duration
+	readTimeout    time.Duration
+	writeTimeout   time.Duration
+}
+
+func newDialer(rawurl string, cnf *config.Config) (*dialer, error) {
+	d := &dialer{
+		address:        rawurl,
+		connectTimeout: time.Duration(cnf.RedisConnectTimeout) * time.Millisecond,
+		readTimeout:    time.Duration(cnf.RedisReadTimeout) * time.Millisecond,
+		writeTimeout:   time.Duration(cnf.RedisWriteTimeout) * time.Millisecond,
+	}
+
+	if d.connectTimeout <= 0 {
+		d.connectTimeout = defaultRedisConnectTimeout
+	}
+
+	if !strings.Contains(rawurl, "://") {
+		return d, nil
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		if d.tls, err = tlsConfig(u, cnf); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("Unsupported redis URL scheme " + u.Scheme)
+	}
+
+	d.address = u.Host
+	if _, _, err := net.SplitHostPort(d.address); err != nil {
+		d.address = net.JoinHostPort(d.address, "6379")
+	}
+
+	if u.User != nil {
+		password, ok := u.User.Password()
+		if !ok {
+			return nil, errors.New("Redis URL user has no password")
+		}
+
+		d.username, d.password = u.User.Username(), password
+	}
+
+	if path := strings.Trim(u.Path, "/"); path != "" {
+		if d.db, err = strconv.Atoi(path); err != nil {
+			return nil, errors.New("Invalid redis database " + path)
+		}
+	}
+
+	return d, nil
+}
+
+func tlsConfig(u *url.URL, cnf *config.Config) (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		host = u.Host
+	}
+
+	c := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: cnf.RedisTLSSkipVerify,
+	}
+
+	if cnf.RedisTLSCA != "" {
+		pem, err := ioutil.ReadFile(cnf.RedisTLSCA)
+		if err != nil {
+			return nil, err
+		}
+
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No certificates found in " + cnf.RedisTLSCA)
+		}
+	}
+
+	if cnf.RedisTLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(cnf.RedisTLSCert, cnf.RedisTLSKey)
+		if err != nil {
+			return nil, err
+		}
+
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	return c, nil
+}
+
+// id identifies the server and database, without credentials.
+func (d *dialer) id() string {
+	if d.db != 0 {
+		return d.address + "/" + strconv.Itoa(d.db)
+	}
+
+	return d.address
+}
+
+// at returns a dialer for another server with the same settings.
+func (d *dialer) at(address string) *dialer {
+	c := *d
+	c.address = address
+
+	if d.tls != nil {
+		c.tls = d.tls.Clone()
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			c.tls.ServerName = host
+		}
+	}
+
+	return &c
+}
+
+// dial opens a connection for commands.
+func (d *dialer) dial() (redis.Conn, error) { return d.dialTimeout(d.readTimeout) }
+
+// dialSubscriber opens a connection for pub/sub, which can wait on messages
+// indefinitely.
+func (d *dialer) dialSubscriber() (redis.Conn, error) { return d.dialTimeout(0) }
+
+func (d *dialer) dialTimeout(readTimeout time.Duration) (redis.Conn, error) {
+	nc, err := net.DialTimeout("tcp", d.address, d.connectTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.tls != nil {
+		tc := tls.Client(nc, d.tls)
+		tc.SetDeadline(time.Now().Add(d.connectTimeout))
+
+		if err := tc.Handshake(); err != nil {
+			nc.Close()
+			return nil, err
+		}
+
+		tc.SetDeadline(time.Time{})
+		nc = tc
+	}
+
+	conn := redis.NewConn(nc, readTimeout, d.writeTimeout)
+
+	if d.password != "" {
+		args := []interface{}{d.password}
+		if d.username != "" {
+			args = []interface{}{d.username, d.password}
+		}
+
+		if _, err := conn.Do("AUTH", args...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if d.db != 0 {
+		if _, err := conn.Do("SELECT", d.db); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+func newPool(dial func() (redis.Conn, error), cnf *config.Config) *pool {
+	p := &redis.Pool{
+		Dial:        dial,
+		MaxIdle:     cnf.RedisMaxIdle,
+		IdleTimeout: time.Duration(cnf.RedisIdleTimeout) * time.Second,
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+
+	if p.MaxIdle <= 0 {
+		p.MaxIdle = defaultRedisMaxIdle
+	}
+
+	if p.IdleTimeout <= 0 {
+		p.IdleTimeout = defaultRedisIdleTimeout
+	}
+
+	var slots chan struct{}
+	if cnf.RedisMaxActive > 0 {
+		slots = make(chan struct{}, cnf.RedisMaxActive)
+	}
+
+	timeout := time.Duration(cnf.RedisPoolTimeout) * time.Millisecond
+	if timeout <= 0 {
+		timeout = defaultRedisPoolTimeout
+	}
+
+	return &pool{Pool: p, slots: slots, timeout: timeout}
+}
+
+// ErrPoolTimeout is the error of a connection that wasn't handed out in time.
+var ErrPoolTimeout = errors.New("Timed out waiting for a redis connection")
+
+// A pool hands out connections to a redis server. With a limit on the number
+// of active connections, getting one waits for another to be closed, rather
+// than failing with redis.ErrPoolExhausted. It waits up to the timeout, after
+// which the connection fails with ErrPoolTimeout.
+type pool struct {
+	*redis.Pool
+
+	slots   chan struct{} // one for every active connection
+	timeout time.Duration
+}
+
+func (p *pool) Get() redis.Conn {
+	if p.slots == nil {
+		return p.Pool.Get()
+	}
+
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		timer := time.NewTimer(p.timeout)
+		defer timer.Stop()
+
+		select {
+		case p.slots <- struct{}{}:
+		case <-timer.C:
+			return errorConn{ErrPoolTimeout}
+		}
+	}
+
+	return &pooledConn{Conn: p.Pool.Get(), slots: p.slots}
+}
+
+// with returns a connection for use while held is open. Waiting for a slot
+// then could wait on the holder itself, so held is shared if it came from
+// this pool, and otherwise a connection is only handed out if there's a slot
+// free right away. A shared connection is only used by its holder's
+// goroutine, and never in the middle of the holder's transaction.
+func (p *pool) with(held redis.Conn) redis.Conn {
+	if p.slots == nil {
+		return p.Pool.Get()
+	}
+
+	if c, ok := held.(*pooledConn); ok && c.slots == p.slots {
+		return sharedConn{c}
+	}
+
+	select {
+	case p.slots <- struct{}{}:
+		return &pooledConn{Conn: p.Pool.Get(), slots: p.slots}
+	default:
+		return errorConn{redis.ErrPoolExhausted}
+	}
+}
+
+// A pooledConn frees its slot in the pool when it's closed.
+type pooledConn struct {
+	redis.Conn
+
+	slots chan struct{}
+	once  sync.Once
+}
+
+func (c *pooledConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { <-c.slots })
+
+	return err
+}
+
+// A sharedConn is a connection borrowed from its holder, who closes it.
+type sharedConn struct {
+	redis.Conn
+}
+
+func (sharedConn) Close() error { return nil }
+
+// An errorConn fails every command with its error.
+type errorConn struct {
+	err error
+}
+
+func (c errorConn) Close() error                                   { return nil }
+func (c errorConn) Err() error                                     { return c.err }
+func (c errorConn) Do(string, ...interface{}) (interface{}, error) { return nil, c.err }
+func (c errorConn) Send(string, ...interface{}) error              { return c.err }
+func (c errorConn) Flush() error                                   { return c.err }
+func (c errorConn) Receive() (interface{}, error)                  { return nil, c.err }
+
+// A backend hands out connections to the redis servers holding streams.
+type backend interface {
+	// get returns a connection to the server holding the named stream.
+	get(name string) redis.Conn
+
+	// conn returns a connection to the server holding key.
+	conn(key string) redis.Conn
+
+	// with returns a connection to the server holding key, for use while
+	// held is open. It never waits for a connection to be freed.
+	with(held redis.Conn, key string) redis.Conn
+
+	// primaries returns a connection to every primary server.
+	primaries() []redis.Conn
+}
+
+// A server is a backend of a single redis server.
+type server struct {
+	pool interface {
+		Get() redis.Conn
+	}
+}
+
+func (s server) get(name string) redis.Conn { return s.pool.Get() }
+
+func (s server) conn(key string) redis.Conn { return s.pool.Get() }
+
+func (s server) with(held redis.Conn, key string) redis.Conn {
+	if p, ok := s.pool.(*pool); ok {
+		return p.with(held)
+	}
+
+	return s.pool.Get()
+}
+
+func (s server) primaries() []redis.Conn { return []redis.Conn{s.pool.Get()} }
+
+// connTo returns a connection to the server holding key on the shard, for a
+// command sent while the stream holds its own connection.
+func (s *Stream) connTo(sh *shard, key string) redis.Conn {
+	if s.conn == nil {
+		return sh.servers.conn(key)
+	}
+
+	return sh.servers.with(s.conn, key)
+}
+
+// backoff returns a retry delay that starts at delay and doubles with every
+// attempt, up to maxRedisRetryDelay.
+func backoff(delay time.Duration) func(attempt int) time.Duration {
+	return func(attempt int) time.Duration {
+		d := delay << uint(attempt-1)
+		if d <= 0 || d > maxRedisRetryDelay {
+			d = maxRedisRetryDelay
+		}
+
+		return d
+	}
+}
+
+// transient reports whether a command that failed with err may succeed on a
+// new connection: the connection broke, or the server is failing over or
+// still loading its data. Any other error is permanent.
+func transient(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if _, ok := err.(net.Error); ok || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+
+	e, ok := err.(redis.Error)
+	if !ok {
+		return false
+	}
+
+	for _, prefix := range []string{"LOADING ", "READONLY ", "MASTERDOWN ", "TRYAGAIN ", "CLUSTERDOWN ", "MOVED ", "ASK "} {
+		if strings.HasPrefix(string(e), prefix) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,185 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/htee/hteed/Godeps/_workspace/src/code.google.com/p/go.net/context"
+	"github.com/htee/hteed/Godeps/_workspace/src/github.com/garyburd/redigo/redis"
+)
+
+var (
+	resumeTimeout time.Duration
+
+	ErrNotResumable = errors.New("Stream can't be resumed with this token")
+)
+
+const defaultResumeTimeout = 5 * time.Minute
+
+// A recording whose connection drops is suspended rather than finished. Its
+// lease is kept for resumeTimeout, along with the number of bytes received
+// from the recorder and the data the redactor held back, so that the
+// recorder can reconnect with its lease token and carry on from the last
+// byte it believes was stored. A suspended stream that isn't resumed in time
+// is aborted by the lease sweeper.
+
+// A ResumeOffsetError is returned when a recorder resumes from an offset
+// past the data received before its connection dropped.
+type ResumeOffsetError struct {
+	Received int64
+}
+
+func (e ResumeOffsetError) Error() string {
+	return fmt.Sprintf("Only %d bytes were received, resume from there", e.Received)
+}
+
+func (s *Stream) receivedKey() string { return s.key("received:") }
+
+// Resume takes the stream's lease back from a suspended recording with the
+// given token, to carry on recording from offset, which is the number of
+// bytes the recorder believes were received. Data before the end of what was
+// received is skipped.
+func Resume(ctx context.Context, name, token string, offset int64) (*Stream, error) {
+	s := newStream(ctx, name)
+	s.redactor = newRedactor(redactions(ctx))
+
+	if err := s.resume(token, offset); err != nil {
+		s.close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *Stream) resume(token string, offset int64) error {
+	r := &Stream{Name: s.Name, conn: s.conn}
+
+	state, size, err := r.snapshot()
+	if err != nil {
+		return err
+	} else if state != Opened {
+		return ErrNotResumable
+	}
+
+	s.conn.Send("WATCH", s.leaseKey(), s.receivedKey())
+
+	if lease, err := redis.String(s.conn.Do("GET", s.leaseKey())); err != nil || lease != token {
+		s.conn.Do("UNWATCH")
+		return ErrNotResumable
+	}
+
+	values, err := redis.Strings(s.conn.Do("HGETALL", s.receivedKey()))
+	if err != nil {
+		s.conn.Do("UNWATCH")
+		return err
+	}
+
+	fields := make(map[string]string)
+	for i := 0; i+1 < len(values); i += 2 {
+		fields[values[i]] = values[i+1]
+	}
+
+	// The recording is still running, its connection hasn't dropped yet.
+	if _, ok := fields["received"]; !ok {
+		s.conn.Do("UNWATCH")
+		return ErrWriterConflict
+	}
+
+	received, err := strconv.ParseInt(fields["received"], 10, 64)
+	if err != nil {
+		s.conn.Do("UNWATCH")
+		return err
+	}
+
+	if offset < 0 || offset > received {
+		s.conn.Do("UNWATCH")
+		return ResumeOffsetError{received}
+	}
+
+	s.lease = newLeaseToken()
+
+	// The suspended recording's lease is given up when leases are disabled.
+	s.conn.Send("MULTI")
+	if leaseTTL > 0 {
+		s.conn.Send("SET", s.leaseKey(), s.lease, "PX", leaseMillis())
+		s.conn.Send("DEL", s.receivedKey())
+	} else {
+		s.conn.Send("DEL", s.leaseKey(), s.receivedKey())
+	}
+	if reply, err := s.conn.Do("EXEC"); err != nil {
+		return err
+	} else if reply == nil {
+		return ErrWriterConflict
+	}
+
+	if err := s.index("ZADD", leaseExpiry(), s.Name); err != nil {
+		return err
+	}
+
+	s.segmentSize = segmentSize
+	s.received = received
+	s.skip = received - offset
+
+	if err := s.adopt(r, size); err != nil {
+		return err
+	}
+
+	// The data held back when the recording was suspended is redacted along
+	// with the data that follows it.
+	if held := []byte(fields["held"]); s.redactor != nil {
+		s.redactor.pending = held
+	} else {
+		s.queue(held)
+	}
+
+	return nil
+}
+
+// suspend keeps the stream open for resumeTimeout after its recorder's
+// connection dropped.
+func (s *Stream) suspend() error {
+	s.conn.Send("MULTI")
+	s.conn.Send("HMSET", s.receivedKey(), "received", s.received, "held", s.redactor.held())
+	s.conn.Send("SET", s.leaseKey(), s.lease, "PX", int64(resumeTimeout/time.Millisecond))
+	if _, err := s.conn.Do("EXEC"); err != nil {
+		return err
+	}
+
+	expiry := time.Now().Add(resumeTimeout).UnixNano() / int64(time.Millisecond)
+
+	return s.index("ZADD", expiry, s.Name)
+}
+
+// Token returns the token for resuming the recording.
+func (s *Stream) Token() string { return s.lease }
+
+// Offset returns the number of bytes received from the recorder before this
+// connection.
+func (s *Stream) Offset() int64 { return s.received - s.skip }
+
+// A skipReader discards the first n bytes it reads.
+type skipReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *skipReader) Read(p []byte) (int, error) {
+	for r.n > 0 {
+		buf := p
+		if int64(len(buf)) > r.n {
+			buf = buf[:r.n]
+		}
+
+		n, err := r.r.Read(buf)
+		r.n -= int64(n)
+
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return r.r.Read(p)
+}
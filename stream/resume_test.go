@@ -0,0 +1,164 @@
+package stream
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/htee/hteed/Godeps/_workspace/src/code.google.com/p/go.net/context"
+)
+
+func TestResume(t *testing.T) {
+	defer func(ttl, timeout time.Duration, r *ring) {
+		leaseTTL, resumeTimeout, shards = ttl, timeout, r
+	}(leaseTTL, resumeTimeout, shards)
+	leaseTTL, resumeTimeout = time.Minute, time.Minute
+
+	conn := newMemConn()
+	shards = newRing(memShard("mem:6379", conn))
+
+	name := "/test/resumed"
+
+	s, err := Open(context.Background(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := s.Token()
+
+	// The recorder's connection drops after sending part of its data.
+	r, w := io.Pipe()
+	s.Record(r)
+	w.Write([]byte("hello wor"))
+	w.CloseWithError(io.ErrUnexpectedEOF)
+	<-s.Done()
+
+	if s.Err != nil {
+		t.Fatal(s.Err)
+	}
+
+	if _, err := Resume(context.Background(), name, "bogus", 0); err != ErrNotResumable {
+		t.Errorf("resumed with a bogus token with %v, want ErrNotResumable", err)
+	}
+
+	if _, err := Resume(context.Background(), name, token, 20); err != (ResumeOffsetError{9}) {
+		t.Errorf("resumed past the received data with %v, want ResumeOffsetError{9}", err)
+	}
+
+	// The recorder only saw its first 6 bytes acknowledged, and resends the
+	// rest.
+	s, err = Resume(context.Background(), name, token, 6)
+	if err != nil {
+		t.Fatal(err)
+	} else if s.Offset() != 6 {
+		t.Errorf("resumed at offset %d, want 6", s.Offset())
+	}
+
+	if _, err := Resume(context.Background(), name, token, 6); err != ErrNotResumable {
+		t.Errorf("resumed twice with %v, want ErrNotResumable", err)
+	}
+
+	s.Record(strings.NewReader("world!"))
+	<-s.Done()
+
+	if s.Err != nil {
+		t.Fatal(s.Err)
+	}
+
+	v := &Stream{Name: name, conn: conn}
+	if state, size, err := v.snapshot(); err != nil {
+		t.Fatal(err)
+	} else if state != Closed || size != 12 {
+		t.Errorf("stream is %d bytes in state %d, want 12 bytes closed", size, state)
+	}
+
+	if buf, err := v.readRange(0, 12); err != nil || string(buf) != "hello world!" {
+		t.Errorf("stream reads %q, %v", buf, err)
+	}
+
+	if _, ok := conn.hashes[s.receivedKey()]; ok {
+		t.Error("finished stream kept its received count")
+	}
+}
+
+func TestResumeRedaction(t *testing.T) {
+	defer func(ttl, timeout time.Duration, r *ring) {
+		leaseTTL, resumeTimeout, shards = ttl, timeout, r
+	}(leaseTTL, resumeTimeout, shards)
+	leaseTTL, resumeTimeout = time.Minute, time.Minute
+
+	conn := newMemConn()
+	shards = newRing(memShard("mem:6379", conn))
+
+	name := "/test/resumed-secret"
+	ctx := WithRedactions(context.Background(), []string{"s3cret"})
+
+	s, err := Open(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The connection drops part way through the secret.
+	r, w := io.Pipe()
+	s.Record(r)
+	w.Write([]byte("hello s3c"))
+	w.CloseWithError(io.ErrUnexpectedEOF)
+	<-s.Done()
+
+	if s.Err != nil {
+		t.Fatal(s.Err)
+	}
+
+	if s, err = Resume(ctx, name, s.Token(), 9); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Record(strings.NewReader("ret!"))
+	<-s.Done()
+
+	if s.Err != nil {
+		t.Fatal(s.Err)
+	}
+
+	v := &Stream{Name: name, conn: conn}
+	if _, size, err := v.snapshot(); err != nil {
+		t.Fatal(err)
+	} else if buf, err := v.readRange(0, size); err != nil || string(buf) != "hello [REDACTED]!" {
+		t.Errorf("stream reads %q, %v, want the secret redacted", buf, err)
+	}
+}
+
+func TestDropWithoutResume(t *testing.T) {
+	defer func(ttl, timeout time.Duration, r *ring) {
+		leaseTTL, resumeTimeout, shards = ttl, timeout, r
+	}(leaseTTL, resumeTimeout, shards)
+	leaseTTL, resumeTimeout = time.Minute, -1
+
+	conn := newMemConn()
+	shards = newRing(memShard("mem:6379", conn))
+
+	s, err := Open(context.Background(), "/test/dropped")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reset := errors.New("connection reset by peer")
+
+	r, w := io.Pipe()
+	s.Record(r)
+	w.Write([]byte("hello"))
+	w.CloseWithError(reset)
+	<-s.Done()
+
+	if s.Err != reset {
+		t.Errorf("dropped recording failed with %v, want %v", s.Err, reset)
+	}
+
+	v := &Stream{Name: s.Name, conn: conn}
+	if state, size, err := v.snapshot(); err != nil {
+		t.Fatal(err)
+	} else if state != Aborted || size != 5 {
+		t.Errorf("stream is %d bytes in state %d, want 5 bytes aborted", size, state)
+	}
+}
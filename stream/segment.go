@@ -0,0 +1,343 @@
+package stream
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/htee/hteed/Godeps/_workspace/src/github.com/garyburd/redigo/redis"
+)
+
+var (
+	segmentSize int64
+	compression string
+)
+
+const defaultSegmentSize = 32 << 20
+
+// Stream data is split across segment keys of segmentSize bytes each, so
+// that no single key grows past what redis can hold. A stream's manifest
+// records the segment size it was written with and its number of segments.
+// Streams without a manifest have a single segment.
+//
+// With gzip compression enabled, each segment is compressed as it's written
+// and the raw segment key is swapped for a compressed one once the segment
+// is full or the stream finishes. The manifest flags each compressed segment,
+// since a segment that was started without compression is never compressed,
+// and records the size of the stream once its last segment is. A segment
+// flagged as compressed whose compressed key is missing is read raw.
+
+func (s *Stream) segmentKey(i int64) string {
+	if i == 0 {
+		return s.dataKey()
+	}
+
+	return s.key("data:" + strconv.FormatInt(i, 10) + ":")
+}
+
+func (s *Stream) compressedKey(i int64) string {
+	return s.key("data:" + strconv.FormatInt(i, 10) + ".gz:")
+}
+
+func (s *Stream) manifestKey() string { return s.key("manifest:") }
+
+// compressedField is the manifest field flagging segment i as compressed.
+func compressedField(i int64) string {
+	return "compressed:" + strconv.FormatInt(i, 10)
+}
+
+// A compressor gzips a segment as it's appended.
+type compressor struct {
+	segment int64
+	buf     bytes.Buffer
+	w       *gzip.Writer
+}
+
+func newCompressor(segment int64) *compressor {
+	c := &compressor{segment: segment}
+	c.w = gzip.NewWriter(&c.buf)
+
+	return c
+}
+
+// sendAppend queues the commands appending buf to the stream, rolling over to
+// a new segment each time the current one is full.
+func (s *Stream) sendAppend(buf []byte) {
+	if s.segmentSize <= 0 {
+		s.conn.Send("APPEND", s.dataKey(), buf)
+		return
+	}
+
+	if s.size == 0 {
+		s.conn.Send("HMSET", s.manifestKey(), "segment-size", s.segmentSize, "segments", 1)
+	}
+
+	for offset := s.size; len(buf) > 0; {
+		i := offset / s.segmentSize
+
+		n := (i+1)*s.segmentSize - offset
+		if n > int64(len(buf)) {
+			n = int64(len(buf))
+		}
+
+		if i > 0 && offset%s.segmentSize == 0 {
+			s.conn.Send("HSET", s.manifestKey(), "segments", i+1)
+		}
+
+		s.conn.Send("APPEND", s.segmentKey(i), buf[:n])
+
+		if compression == "gzip" {
+			// Only segments written from their start can be compressed.
+			if offset%s.segmentSize == 0 {
+				s.gz = newCompressor(i)
+			}
+
+			if s.gz != nil && s.gz.segment == i {
+				s.gz.w.Write(buf[:n])
+
+				if offset+n == (i+1)*s.segmentSize {
+					s.sendSeal(offset + n)
+				}
+			}
+		}
+
+		buf = buf[n:]
+		offset += n
+	}
+}
+
+// sendSeal queues the commands replacing the segment being compressed with
+// its compressed form. size is the size of the stream up to the segment's
+// end.
+func (s *Stream) sendSeal(size int64) {
+	i := s.gz.segment
+	s.gz.w.Close()
+
+	s.conn.Send("SET", s.compressedKey(i), s.gz.buf.Bytes())
+	s.conn.Send("HMSET", s.manifestKey(), compressedField(i), 1, "size", size)
+	s.conn.Send("DEL", s.segmentKey(i))
+
+	s.gz = nil
+}
+
+// resumeCompression starts compressing the stream's last segment again from
+// what's stored of it, since the compressor may have been fed data that was
+// never stored.
+func (s *Stream) resumeCompression() error {
+	s.gz = nil
+
+	if compression != "gzip" || s.segmentSize <= 0 || s.size%s.segmentSize == 0 {
+		return nil
+	}
+
+	i := s.size / s.segmentSize
+
+	// The segment was already sealed if its raw key is gone.
+	raw, err := redis.Bytes(s.conn.Do("GET", s.segmentKey(i)))
+	if err == redis.ErrNil {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	s.gz = newCompressor(i)
+	s.gz.w.Write(raw)
+
+	return nil
+}
+
+// unseal swaps the stream's last segment back to its raw form if it was
+// compressed when the stream finished part way through it, so that the
+// stream can be appended to again. The stream's layout must be loaded, and
+// size is the size of its data.
+func (s *Stream) unseal(size int64) error {
+	i := s.segments - 1
+	if s.segmentSize <= 0 || !s.compressed[i] || size%s.segmentSize == 0 {
+		return nil
+	}
+
+	data, err := redis.Bytes(s.conn.Do("GET", s.compressedKey(i)))
+	if err != nil {
+		return err
+	}
+
+	raw, err := gunzip(data)
+	if err != nil {
+		return err
+	}
+
+	s.conn.Send("MULTI")
+	s.conn.Send("SET", s.segmentKey(i), raw)
+	s.conn.Send("HDEL", s.manifestKey(), compressedField(i))
+	s.conn.Send("DEL", s.compressedKey(i))
+	if _, err := s.conn.Do("EXEC"); err != nil {
+		return err
+	}
+
+	delete(s.compressed, i)
+
+	return nil
+}
+
+// loadManifest sets the stream's layout from the fields of its manifest.
+func (s *Stream) loadManifest(fields []string) error {
+	s.segmentSize, s.segments, s.compressedSize = 0, 1, 0
+	s.compressed = make(map[int64]bool)
+
+	for i := 0; i+1 < len(fields); i += 2 {
+		n, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil {
+			return err
+		}
+
+		if strings.HasPrefix(fields[i], "compressed:") {
+			segment, err := strconv.ParseInt(strings.TrimPrefix(fields[i], "compressed:"), 10, 64)
+			if err != nil {
+				return err
+			}
+			s.compressed[segment] = n != 0
+			continue
+		}
+
+		switch fields[i] {
+		case "segment-size":
+			s.segmentSize = n
+		case "segments":
+			s.segments = n
+		case "size":
+			s.compressedSize = n
+		}
+	}
+
+	return nil
+}
+
+// loadSegments reads the stream's manifest.
+func (s *Stream) loadSegments() error {
+	fields, err := redis.Strings(s.conn.Do("HGETALL", s.manifestKey()))
+	if err != nil {
+		return err
+	}
+
+	return s.loadManifest(fields)
+}
+
+// dataSize returns the size of the stream's data, given the length of its
+// first segment.
+func (s *Stream) dataSize(first int64) (int64, error) {
+	if s.compressed[s.segments-1] {
+		return s.compressedSize, nil
+	} else if s.segments == 1 {
+		return first, nil
+	}
+
+	last, err := redis.Int64(s.conn.Do("STRLEN", s.segmentKey(s.segments-1)))
+	if err != nil {
+		return 0, err
+	}
+
+	return (s.segments-1)*s.segmentSize + last, nil
+}
+
+// readRange returns the stream data from start up to end.
+func (s *Stream) readRange(start, end int64) ([]byte, error) {
+	if s.segmentSize <= 0 {
+		return redis.Bytes(s.conn.Do("GETRANGE", s.dataKey(), start, end-1))
+	}
+
+	var buf []byte
+	for start < end {
+		i := start / s.segmentSize
+
+		segEnd := (i + 1) * s.segmentSize
+		if segEnd > end {
+			segEnd = end
+		}
+
+		base := i * s.segmentSize
+		page, err := s.readSegment(i, start-base, segEnd-base)
+		if err != nil {
+			return nil, err
+		}
+
+		buf = append(buf, page...)
+
+		if int64(len(page)) < segEnd-start {
+			break
+		}
+
+		start = segEnd
+	}
+
+	return buf, nil
+}
+
+// readSegment returns the data of segment i from start up to end.
+func (s *Stream) readSegment(i, start, end int64) ([]byte, error) {
+	if !s.compressed[i] {
+		page, err := redis.Bytes(s.conn.Do("GETRANGE", s.segmentKey(i), start, end-1))
+		if err != nil || int64(len(page)) == end-start {
+			return page, err
+		}
+
+		// The segment may have been compressed since the manifest was read.
+		if err := s.loadSegments(); err != nil || !s.compressed[i] {
+			return page, err
+		}
+	}
+
+	if s.cached != i+1 {
+		data, err := redis.Bytes(s.conn.Do("GET", s.compressedKey(i)))
+		if err == redis.ErrNil {
+			// The segment was swapped back to its raw form, or never left it.
+			return redis.Bytes(s.conn.Do("GETRANGE", s.segmentKey(i), start, end-1))
+		} else if err != nil {
+			return nil, err
+		}
+
+		if s.cache, err = gunzip(data); err != nil {
+			return nil, err
+		}
+		s.cached = i + 1
+	}
+
+	if end > int64(len(s.cache)) {
+		end = int64(len(s.cache))
+	}
+
+	if start >= end {
+		return []byte{}, nil
+	}
+
+	return s.cache[start:end], nil
+}
+
+func gunzip(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+// dataKeys returns every key holding the stream's data.
+func (s *Stream) dataKeys() ([]interface{}, error) {
+	if err := s.loadSegments(); err != nil {
+		return nil, err
+	}
+
+	keys := []interface{}{s.manifestKey()}
+	for i := int64(0); i < s.segments; i++ {
+		keys = append(keys, s.segmentKey(i), s.compressedKey(i))
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,490 @@
+package stream
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSegmentedAppend(t *testing.T) {
+	conn := newMemConn()
+	s := &Stream{Name: "/test/segmented", conn: conn, segmentSize: 4}
+
+	for _, chunk := range []string{"abc", "defghi", "j", "klmnopqr"} {
+		if err := s.append([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, want := range []string{"abcd", "efgh", "ijkl", "mnop", "qr"} {
+		if got := string(conn.strings[s.segmentKey(int64(i))]); got != want {
+			t.Errorf("segment %d is %q, want %q", i, got, want)
+		}
+	}
+
+	r := &Stream{Name: s.Name, conn: conn}
+
+	state, size, err := r.snapshot()
+	if err != nil {
+		t.Fatal(err)
+	} else if state != Opened || size != 18 {
+		t.Errorf("snapshot is %d bytes in state %d, want 18 bytes opened", size, state)
+	}
+
+	if buf, err := r.readRange(3, 15); err != nil {
+		t.Error(err)
+	} else if string(buf) != "defghijklmno" {
+		t.Errorf("read range is %q, want %q", buf, "defghijklmno")
+	}
+
+	if err := r.delete(); err != nil {
+		t.Error(err)
+	} else if len(conn.strings) != 0 || len(conn.hashes) != 0 {
+		t.Errorf("delete left keys behind: %v %v", conn.strings, conn.hashes)
+	}
+}
+
+// memConn is a redis.Conn holding strings, hashes, lists and sorted sets in
+// memory, for the subset of commands used by streams. Commands sent after
+// MULTI run on EXEC.
+type memConn struct {
+	strings  map[string][]byte
+	hashes   map[string]map[string][]byte
+	lists    map[string][][]byte
+	zsets    map[string]map[string]float64
+	messages map[string][][]byte
+
+	mu    sync.Mutex
+	queue [][]interface{}
+	multi bool
+}
+
+func newMemConn() *memConn {
+	return &memConn{
+		strings:  make(map[string][]byte),
+		hashes:   make(map[string]map[string][]byte),
+		lists:    make(map[string][][]byte),
+		zsets:    make(map[string]map[string]float64),
+		messages: make(map[string][][]byte),
+	}
+}
+
+func (c *memConn) Close() error { return nil }
+
+func (c *memConn) Err() error { return nil }
+
+func (c *memConn) Send(cmd string, args ...interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.send(cmd, args...)
+}
+
+func (c *memConn) send(cmd string, args ...interface{}) error {
+	switch {
+	case cmd == "MULTI":
+		c.multi = true
+	case c.multi:
+		c.queue = append(c.queue, append([]interface{}{cmd}, args...))
+	default:
+		_, err := c.exec(cmd, args)
+		return err
+	}
+
+	return nil
+}
+
+func (c *memConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cmd != "EXEC" {
+		if cmd == "MULTI" || c.multi {
+			return nil, c.send(cmd, args...)
+		}
+
+		return c.exec(cmd, args)
+	}
+
+	replies := make([]interface{}, len(c.queue))
+	for i, q := range c.queue {
+		reply, err := c.exec(q[0].(string), q[1:])
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+
+	c.queue, c.multi = nil, false
+
+	return replies, nil
+}
+
+func (c *memConn) Flush() error { return nil }
+
+func (c *memConn) Receive() (interface{}, error) { return nil, errors.New("not supported") }
+
+func (c *memConn) exec(cmd string, args []interface{}) (interface{}, error) {
+	key := arg(args, 0)
+
+	switch cmd {
+	case "GET":
+		if v, ok := c.strings[key]; ok {
+			return v, nil
+		}
+		return nil, nil
+	case "GETSET":
+		v, ok := c.strings[key]
+		c.strings[key] = []byte(arg(args, 1))
+		if ok {
+			return v, nil
+		}
+		return nil, nil
+	case "SET":
+		for i := 2; i+1 < len(args); i++ {
+			if arg(args, i) == "PX" && arg(args, i+1) == "0" {
+				return nil, errors.New("ERR invalid expire time in set")
+			}
+		}
+		if _, ok := c.strings[key]; ok && len(args) > 2 && arg(args, 2) == "NX" {
+			return nil, nil
+		}
+		c.strings[key] = []byte(arg(args, 1))
+		return "OK", nil
+	case "APPEND":
+		c.strings[key] = append(c.strings[key], arg(args, 1)...)
+		return int64(len(c.strings[key])), nil
+	case "STRLEN":
+		return int64(len(c.strings[key])), nil
+	case "GETRANGE":
+		v := c.strings[key]
+		start, _ := strconv.Atoi(arg(args, 1))
+		end, _ := strconv.Atoi(arg(args, 2))
+		if end < 0 || end >= len(v) {
+			end = len(v) - 1
+		}
+		if start > end {
+			return []byte{}, nil
+		}
+		return v[start : end+1], nil
+	case "HSET", "HMSET":
+		if c.hashes[key] == nil {
+			c.hashes[key] = make(map[string][]byte)
+		}
+		for i := 1; i+1 < len(args); i += 2 {
+			c.hashes[key][arg(args, i)] = []byte(arg(args, i+1))
+		}
+		return "OK", nil
+	case "HSETNX":
+		if _, ok := c.hashes[key][arg(args, 1)]; ok {
+			return int64(0), nil
+		}
+		if c.hashes[key] == nil {
+			c.hashes[key] = make(map[string][]byte)
+		}
+		c.hashes[key][arg(args, 1)] = []byte(arg(args, 2))
+		return int64(1), nil
+	case "HDEL":
+		if _, ok := c.hashes[key][arg(args, 1)]; !ok {
+			return int64(0), nil
+		}
+		delete(c.hashes[key], arg(args, 1))
+		return int64(1), nil
+	case "RPUSH":
+		for i := 1; i < len(args); i++ {
+			c.lists[key] = append(c.lists[key], []byte(arg(args, i)))
+		}
+		return int64(len(c.lists[key])), nil
+	case "LRANGE":
+		start, _ := strconv.Atoi(arg(args, 1))
+		items := []interface{}{}
+		for i := start; i < len(c.lists[key]); i++ {
+			items = append(items, c.lists[key][i])
+		}
+		return items, nil
+	case "HGET":
+		if v, ok := c.hashes[key][arg(args, 1)]; ok {
+			return v, nil
+		}
+		return nil, nil
+	case "HGETALL":
+		fields := []interface{}{}
+		for k, v := range c.hashes[key] {
+			fields = append(fields, []byte(k), v)
+		}
+		return fields, nil
+	case "DEL":
+		for i := range args {
+			delete(c.strings, arg(args, i))
+			delete(c.hashes, arg(args, i))
+			delete(c.lists, arg(args, i))
+			delete(c.zsets, arg(args, i))
+		}
+		return int64(len(args)), nil
+	case "EXISTS":
+		_, str := c.strings[key]
+		_, hash := c.hashes[key]
+		_, list := c.lists[key]
+		_, zset := c.zsets[key]
+		if str || hash || list || zset {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case "DUMP":
+		if v, ok := c.strings[key]; ok {
+			return json.Marshal(dump{String: v})
+		} else if v, ok := c.hashes[key]; ok {
+			return json.Marshal(dump{Hash: v})
+		} else if v, ok := c.lists[key]; ok {
+			return json.Marshal(dump{List: v})
+		} else if v, ok := c.zsets[key]; ok {
+			return json.Marshal(dump{Zset: v})
+		}
+		return nil, nil
+	case "RESTORE":
+		var d dump
+		if err := json.Unmarshal([]byte(arg(args, 2)), &d); err != nil {
+			return nil, err
+		}
+		switch {
+		case d.Hash != nil:
+			c.hashes[key] = d.Hash
+		case d.List != nil:
+			c.lists[key] = d.List
+		case d.Zset != nil:
+			c.zsets[key] = d.Zset
+		default:
+			c.strings[key] = d.String
+		}
+		return "OK", nil
+	case "SCAN":
+		keys := []interface{}{}
+		prefix := strings.TrimSuffix(arg(args, 2), "*")
+		for k := range c.strings {
+			if strings.HasPrefix(k, prefix) {
+				keys = append(keys, []byte(k))
+			}
+		}
+		for k := range c.hashes {
+			if strings.HasPrefix(k, prefix) {
+				keys = append(keys, []byte(k))
+			}
+		}
+		for k := range c.lists {
+			if strings.HasPrefix(k, prefix) {
+				keys = append(keys, []byte(k))
+			}
+		}
+		for k := range c.zsets {
+			if strings.HasPrefix(k, prefix) {
+				keys = append(keys, []byte(k))
+			}
+		}
+		return []interface{}{[]byte("0"), keys}, nil
+	case "PTTL":
+		return int64(-1), nil
+	case "WATCH", "UNWATCH":
+		return "OK", nil
+	case "ZADD":
+		if c.zsets[key] == nil {
+			c.zsets[key] = make(map[string]float64)
+		}
+		score, _ := strconv.ParseFloat(arg(args, 1), 64)
+		c.zsets[key][arg(args, 2)] = score
+		return int64(1), nil
+	case "ZSCORE":
+		score, ok := c.zsets[key][arg(args, 1)]
+		if !ok {
+			return nil, nil
+		}
+		return []byte(strconv.FormatFloat(score, 'f', -1, 64)), nil
+	case "ZREM":
+		delete(c.zsets[key], arg(args, 1))
+		return int64(1), nil
+	case "ZRANGE":
+		var members []string
+		for member := range c.zsets[key] {
+			members = append(members, member)
+		}
+		sort.Slice(members, func(i, j int) bool {
+			if a, b := c.zsets[key][members[i]], c.zsets[key][members[j]]; a != b {
+				return a < b
+			}
+			return members[i] < members[j]
+		})
+		reply := []interface{}{}
+		for _, member := range members {
+			reply = append(reply, []byte(member))
+			if arg(args, 3) == "WITHSCORES" {
+				reply = append(reply, []byte(strconv.FormatFloat(c.zsets[key][member], 'f', -1, 64)))
+			}
+		}
+		return reply, nil
+	case "ZRANGEBYSCORE":
+		max, _ := strconv.ParseFloat(arg(args, 2), 64)
+		members := []interface{}{}
+		for member, score := range c.zsets[key] {
+			if score <= max {
+				members = append(members, []byte(member))
+			}
+		}
+		return members, nil
+	case "ZREVRANGEBYSCORE":
+		bound := arg(args, 1)
+		exclusive := strings.HasPrefix(bound, "(")
+		max, err := strconv.ParseFloat(strings.TrimPrefix(bound, "("), 64)
+		if err != nil {
+			max = math.Inf(1)
+		}
+		var members []string
+		for member, score := range c.zsets[key] {
+			if score < max || score == max && !exclusive {
+				members = append(members, member)
+			}
+		}
+		sort.Slice(members, func(i, j int) bool {
+			if a, b := c.zsets[key][members[i]], c.zsets[key][members[j]]; a != b {
+				return a > b
+			}
+			return members[i] > members[j]
+		})
+		offset, _ := strconv.Atoi(arg(args, 5))
+		if offset > len(members) {
+			offset = len(members)
+		}
+		members = members[offset:]
+		count, _ := strconv.Atoi(arg(args, 6))
+		if count < len(members) {
+			members = members[:count]
+		}
+		reply := []interface{}{}
+		for _, member := range members {
+			score := strconv.FormatFloat(c.zsets[key][member], 'f', -1, 64)
+			reply = append(reply, []byte(member), []byte(score))
+		}
+		return reply, nil
+	case "PUBLISH":
+		c.messages[key] = append(c.messages[key], []byte(arg(args, 1)))
+		return int64(0), nil
+	}
+
+	return nil, fmt.Errorf("unsupported command %s", cmd)
+}
+
+// dump is the serialized form of a key for DUMP and RESTORE.
+type dump struct {
+	String []byte
+	Hash   map[string][]byte
+	List   [][]byte
+	Zset   map[string]float64
+}
+
+func arg(args []interface{}, i int) string {
+	if i >= len(args) {
+		return ""
+	}
+
+	switch v := args[i].(type) {
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func TestCompressedSegments(t *testing.T) {
+	defer func(c string) { compression = c }(compression)
+	compression = "gzip"
+
+	conn := newMemConn()
+	s := &Stream{Name: "/test/compressed", conn: conn, segmentSize: 4}
+
+	for _, chunk := range []string{"abc", "defghi", "j"} {
+		if err := s.append([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := int64(0); i < 3; i++ {
+		if _, ok := conn.strings[s.segmentKey(i)]; ok {
+			t.Errorf("raw segment %d was kept", i)
+		}
+		if _, ok := conn.strings[s.compressedKey(i)]; !ok {
+			t.Errorf("segment %d was not compressed", i)
+		}
+	}
+
+	r := &Stream{Name: s.Name, conn: conn}
+
+	if state, size, err := r.snapshot(); err != nil {
+		t.Fatal(err)
+	} else if state != Closed || size != 10 {
+		t.Errorf("snapshot is %d bytes in state %d, want 10 bytes closed", size, state)
+	}
+
+	if buf, err := r.readRange(2, 10); err != nil {
+		t.Error(err)
+	} else if string(buf) != "cdefghij" {
+		t.Errorf("read range is %q, want %q", buf, "cdefghij")
+	}
+}
+
+func TestPartlyCompressedSegments(t *testing.T) {
+	defer func(c string) { compression = c }(compression)
+	compression = ""
+
+	conn := newMemConn()
+	s := &Stream{Name: "/test/partly-compressed", conn: conn, segmentSize: 4}
+
+	// The first segment is started without compression, so it stays raw
+	// while the ones after it are compressed.
+	if err := s.append([]byte("ab")); err != nil {
+		t.Fatal(err)
+	}
+
+	compression = "gzip"
+	for _, chunk := range []string{"cdef", "ghij"} {
+		if err := s.append([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := conn.strings[s.compressedKey(0)]; ok {
+		t.Error("segment 0 was compressed")
+	}
+
+	read := func() {
+		r := &Stream{Name: s.Name, conn: conn}
+
+		if _, size, err := r.snapshot(); err != nil {
+			t.Fatal(err)
+		} else if buf, err := r.readRange(0, size); err != nil {
+			t.Error(err)
+		} else if string(buf) != "abcdefghij" {
+			t.Errorf("read %q, want %q", buf, "abcdefghij")
+		}
+	}
+	read()
+
+	// A segment flagged as compressed is read raw if it has no compressed key.
+	if _, err := conn.Do("HSET", s.manifestKey(), compressedField(0), 1); err != nil {
+		t.Fatal(err)
+	}
+	read()
+}
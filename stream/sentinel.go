@@ -0,0 +1,121 @@
+package stream
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/htee/hteed/Godeps/_workspace/src/github.com/garyburd/redigo/redis"
+)
+
+const defaultSentinelMaster = "mymaster"
+
+// A sentinel discovers the primary server through a set of redis sentinels,
+// asking each in turn until one answers. Connections are always opened to
+// the current primary, and pooled connections are checked to still be on a
+// primary before they are reused, so a failover only fails the commands in
+// flight.
+type sentinel struct {
+	dialer *dialer
+	master string
+
+	mu    sync.Mutex
+	addrs []string
+}
+
+func newSentinel(d *dialer, addrs []string, master string) *sentinel {
+	if master == "" {
+		master = defaultSentinelMaster
+	}
+
+	return &sentinel{
+		dialer: d,
+		master: master,
+		addrs:  append([]string(nil), addrs...),
+	}
+}
+
+// primary returns the address of the primary server. The sentinel that
+// answers is asked first next time.
+func (s *sentinel) primary() (string, error) {
+	s.mu.Lock()
+	addrs := append([]string(nil), s.addrs...)
+	s.mu.Unlock()
+
+	err := errors.New("No redis sentinels configured")
+
+	for i, addr := range addrs {
+		var primary string
+		if primary, err = s.ask(addr); err != nil {
+			continue
+		}
+
+		if i > 0 {
+			s.mu.Lock()
+			s.addrs = append(append([]string{addr}, addrs[:i]...), addrs[i+1:]...)
+			s.mu.Unlock()
+		}
+
+		return primary, nil
+	}
+
+	return "", err
+}
+
+func (s *sentinel) ask(addr string) (string, error) {
+	d := s.dialer.at(addr)
+	d.username, d.password, d.db = "", "", 0
+
+	conn, err := d.dial()
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	reply, err := redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", s.master))
+	if err == redis.ErrNil || err == nil && len(reply) != 2 {
+		return "", errors.New("Unknown redis sentinel master " + s.master)
+	} else if err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(reply[0], reply[1]), nil
+}
+
+func (s *sentinel) dial() (redis.Conn, error) {
+	addr, err := s.primary()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.dialer.at(addr).dial()
+}
+
+func (s *sentinel) dialSubscriber() (redis.Conn, error) {
+	addr, err := s.primary()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.dialer.at(addr).dialSubscriber()
+}
+
+// checkRole fails for connections to a server that is no longer the primary.
+func checkRole(c redis.Conn, t time.Time) error {
+	reply, err := redis.Values(c.Do("ROLE"))
+	if err != nil {
+		return err
+	}
+
+	var role string
+	if len(reply) > 0 {
+		role, _ = redis.String(reply[0], nil)
+	}
+
+	if role != "master" {
+		return errors.New("Redis server is no longer the primary")
+	}
+
+	return nil
+}
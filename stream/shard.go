@@ -0,0 +1,420 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/htee/hteed/Godeps/_workspace/src/github.com/garyburd/redigo/redis"
+)
+
+// shards places every stream on one of the configured redis instances.
+var shards *ring
+
+const shardPoints = 160
+
+// A shard is an independent redis instance, with its own subscriber hub. The
+// hub subscribes and reads snapshots from the shard's replica, if it has one.
+type shard struct {
+	id      string
+	servers backend
+	hub     *hub
+}
+
+func newShard(id string, servers backend, dial func() (redis.Conn, error)) *shard {
+	return &shard{
+		id:      id,
+		servers: servers,
+		hub:     newHub(dial, servers.get),
+	}
+}
+
+// A ring places streams on shards by consistent hashing of their names. Each
+// shard owns shardPoints points on the ring, and a stream belongs to the
+// shard owning the first point at or after the hash of its name, so adding a
+// shard only moves the streams that now hash to it.
+type ring struct {
+	shards []*shard
+	points []point
+}
+
+type point struct {
+	hash  uint32
+	shard *shard
+}
+
+func newRing(shards ...*shard) *ring {
+	r := &ring{shards: shards}
+
+	for _, s := range shards {
+		for i := 0; i < shardPoints; i++ {
+			r.points = append(r.points, point{hash(s.id + "-" + strconv.Itoa(i)), s})
+		}
+	}
+
+	sort.Sort(byHash(r.points))
+
+	return r
+}
+
+func (r *ring) shard(name string) *shard {
+	if len(r.shards) == 1 {
+		return r.shards[0]
+	}
+
+	h := hash(name)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+
+	return r.points[i].shard
+}
+
+func hash(s string) uint32 {
+	h := fnv.New32a()
+	io.WriteString(h, s)
+
+	return h.Sum32()
+}
+
+type byHash []point
+
+func (p byHash) Len() int           { return len(p) }
+func (p byHash) Less(i, j int) bool { return p[i].hash < p[j].hash }
+func (p byHash) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// primaries returns a connection to every primary server of every shard.
+func primaries() []redis.Conn {
+	var conns []redis.Conn
+	for _, s := range shards.shards {
+		conns = append(conns, s.servers.primaries()...)
+	}
+
+	return conns
+}
+
+var (
+	errStreamOpen   = errors.New("still recording")
+	errStreamExists = errors.New("already exists on the new shard")
+)
+
+// Rebalance moves every stream that isn't on the shard it hashes to over to
+// that shard, reporting each move to w. Streams still being recorded are
+// reported and left in place, to be moved by a later run. Streams that also
+// exist on their new shard are reported as conflicts and left in place too,
+// and fail the rebalance once everything else has been moved. Owners' stream
+// indexes and watches, and groups, are moved the same way. With dryRun set,
+// the moves are only reported.
+//
+// It's meant to be run once shards have been added to the configuration.
+// Until it completes, streams still on their old shard can't be played back.
+func Rebalance(w io.Writer, dryRun bool) error {
+	conflicts := 0
+
+	move := func(what string, src, dst *shard, migrate func() error) error {
+		fmt.Fprintf(w, "%s: %s -> %s", what, src.id, dst.id)
+
+		var err error
+		if !dryRun {
+			err = migrate()
+		}
+
+		switch err {
+		case nil:
+		case errStreamOpen:
+			fmt.Fprintf(w, " skipped, %s", err)
+		case errStreamExists:
+			fmt.Fprintf(w, " conflict, %s", err)
+			conflicts++
+		default:
+			fmt.Fprintln(w)
+			return err
+		}
+
+		fmt.Fprintln(w)
+
+		return nil
+	}
+
+	for _, src := range shards.shards {
+		for _, conn := range src.servers.primaries() {
+			names, err := scanStreams(conn)
+			var keys []string
+			if err == nil {
+				keys, err = scanShared(conn)
+			}
+			conn.Close()
+
+			if err != nil {
+				return err
+			}
+
+			for _, name := range names {
+				dst := shards.shard(name)
+				if dst == src {
+					continue
+				}
+
+				if err := move(name, src, dst, func() error { return migrate(name, src, dst) }); err != nil {
+					return err
+				}
+			}
+
+			for _, key := range keys {
+				dst := sharedShard(key)
+				if dst == src {
+					continue
+				}
+
+				if err := move(key, src, dst, func() error { return migrateShared(key, src, dst) }); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if conflicts > 0 {
+		return fmt.Errorf("%d streams or groups exist on both their old and new shard, and were left in place", conflicts)
+	}
+
+	return nil
+}
+
+// scanStreams returns the name of every stream on the server.
+func scanStreams(conn redis.Conn) ([]string, error) {
+	prefix := keyPrefix + "state:"
+
+	keys, err := scanKeys(conn, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(keys))
+	for _, key := range keys {
+		names = append(names, strings.TrimPrefix(key, prefix))
+	}
+
+	return names, nil
+}
+
+// scanShared returns the keys on the server that aren't a stream's: the
+// owners' stream indexes and watches, and the groups. A group's steps are
+// moved along with it.
+func scanShared(conn redis.Conn) ([]string, error) {
+	var shared []string
+	for _, prefix := range []string{"owner:", "watches:", "group:"} {
+		keys, err := scanKeys(conn, keyPrefix+prefix)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range keys {
+			rest := strings.TrimPrefix(key, keyPrefix+prefix)
+			if prefix == "watches:" && strings.HasPrefix(rest, "/") || prefix == "group:" && strings.HasPrefix(rest, "steps:") {
+				continue
+			}
+
+			shared = append(shared, key)
+		}
+	}
+
+	return shared, nil
+}
+
+// scanKeys returns every key on the server starting with prefix.
+func scanKeys(conn redis.Conn, prefix string) ([]string, error) {
+	var keys []string
+	for cursor := "0"; ; {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", prefix+"*", "COUNT", 1000))
+		if err != nil {
+			return nil, err
+		}
+
+		var page []string
+		if _, err := redis.Scan(reply, &cursor, &page); err != nil {
+			return nil, err
+		}
+		keys = append(keys, page...)
+
+		if cursor == "0" {
+			return keys, nil
+		}
+	}
+}
+
+// sharedShard returns the shard a key found by scanShared belongs on. Groups
+// are placed by name, like streams, and owners' keys by the key itself.
+func sharedShard(key string) *shard {
+	if name := strings.TrimPrefix(key, keyPrefix+"group:"); name != key {
+		return shards.shard(name)
+	}
+
+	return shards.shard(key)
+}
+
+// migrate copies the keys of a finished stream to another shard, then deletes
+// them from the original one. The state key is copied last, so that the
+// stream only appears on the new shard once all of its data is there.
+func migrate(name string, src, dst *shard) error {
+	s := &Stream{Name: name, conn: src.servers.get(name)}
+	defer s.conn.Close()
+
+	to := dst.servers.get(name)
+	defer to.Close()
+
+	if state, err := s.getState(); err != nil {
+		return err
+	} else if state == Opened {
+		return errStreamOpen
+	}
+
+	if exists, err := redis.Bool(to.Do("EXISTS", s.stateKey())); err != nil {
+		return err
+	} else if exists {
+		return errStreamExists
+	}
+
+	keys, err := s.dataKeys()
+	if err != nil {
+		return err
+	}
+	keys = append(keys, s.metaKey(), s.markersKey(), s.timesKey(), s.watchesKey(), s.leaseKey(), s.receivedKey(), s.stateKey())
+
+	if err := copyKeys(s.conn, to, keys); err != nil {
+		return err
+	}
+
+	if err := migrateLease(name, src, dst); err != nil {
+		return err
+	}
+
+	_, err = s.conn.Do("DEL", keys...)
+
+	return err
+}
+
+// copyKeys copies the keys that exist, in order, keeping their expiry.
+func copyKeys(from, to redis.Conn, keys []interface{}) error {
+	for _, key := range keys {
+		payload, err := redis.Bytes(from.Do("DUMP", key))
+		if err == redis.ErrNil {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		ttl, err := redis.Int64(from.Do("PTTL", key))
+		if err != nil {
+			return err
+		} else if ttl < 0 {
+			ttl = 0
+		}
+
+		if _, err := to.Do("RESTORE", key, ttl, payload, "REPLACE"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateLease moves the stream's entry in the lease index, if it has one.
+func migrateLease(name string, src, dst *shard) error {
+	from := src.servers.conn(leasesKey())
+	defer from.Close()
+
+	expiry, err := redis.String(from.Do("ZSCORE", leasesKey(), name))
+	if err == redis.ErrNil {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	to := dst.servers.conn(leasesKey())
+	defer to.Close()
+
+	if _, err := to.Do("ZADD", leasesKey(), expiry, name); err != nil {
+		return err
+	}
+
+	_, err = from.Do("ZREM", leasesKey(), name)
+
+	return err
+}
+
+// migrateShared moves an owner's or a group's key to another shard. An
+// owner's stream index and watches are merged into any the owner already
+// has there. A group is moved like a stream, once it's closed.
+func migrateShared(key string, src, dst *shard) error {
+	if name := strings.TrimPrefix(key, keyPrefix+"group:"); name != key {
+		return migrateGroup(name, src, dst)
+	}
+
+	from := src.servers.conn(key)
+	defer from.Close()
+
+	to := dst.servers.conn(key)
+	defer to.Close()
+
+	if strings.HasPrefix(key, keyPrefix+"owner:") {
+		entries, err := redis.Strings(from.Do("ZRANGE", key, 0, -1, "WITHSCORES"))
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i+1 < len(entries); i += 2 {
+			if _, err := to.Do("ZADD", key, entries[i+1], entries[i]); err != nil {
+				return err
+			}
+		}
+	} else {
+		fields, err := redis.Values(from.Do("HGETALL", key))
+		if err != nil {
+			return err
+		} else if len(fields) > 0 {
+			if _, err := to.Do("HMSET", append([]interface{}{key}, fields...)...); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := from.Do("DEL", key)
+
+	return err
+}
+
+// migrateGroup moves a closed group and its steps to another shard, like
+// migrate. The group's key is copied last.
+func migrateGroup(name string, src, dst *shard) error {
+	from := src.servers.get(name)
+	defer from.Close()
+
+	to := dst.servers.get(name)
+	defer to.Close()
+
+	if state, err := redis.Int(from.Do("HGET", groupKey(name), "state")); err != nil {
+		return err
+	} else if State(state) == Opened {
+		return errStreamOpen
+	}
+
+	if exists, err := redis.Bool(to.Do("EXISTS", groupKey(name))); err != nil {
+		return err
+	} else if exists {
+		return errStreamExists
+	}
+
+	keys := []interface{}{stepsKey(name), groupKey(name)}
+	if err := copyKeys(from, to, keys); err != nil {
+		return err
+	}
+
+	_, err := from.Do("DEL", keys...)
+
+	return err
+}
@@ -0,0 +1,162 @@
+package stream
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/htee/hteed/Godeps/_workspace/src/github.com/garyburd/redigo/redis"
+)
+
+func TestRingPlacement(t *testing.T) {
+	a, b, c, d := &shard{id: "a:6379"}, &shard{id: "b:6379"}, &shard{id: "c:6379"}, &shard{id: "d:6379"}
+
+	before := newRing(a, b, c)
+	after := newRing(a, b, c, d)
+
+	moved := 0
+	for i := 0; i < 10000; i++ {
+		name := fmt.Sprintf("/user/stream-%d", i)
+
+		if s := after.shard(name); s != before.shard(name) {
+			if s != d {
+				t.Fatalf("%s moved from %s to %s", name, before.shard(name).id, s.id)
+			}
+			moved++
+		}
+	}
+
+	if moved < 1500 || moved > 3500 {
+		t.Errorf("%d of 10000 streams moved to the new shard, want about 2500", moved)
+	}
+}
+
+func memShard(id string, conn *memConn) *shard {
+	p := &redis.Pool{Dial: func() (redis.Conn, error) { return conn, nil }}
+
+	return newShard(id, server{p}, nil)
+}
+
+func TestRebalance(t *testing.T) {
+	defer func(r *ring) { shards = r }(shards)
+
+	oldConn, newConn := newMemConn(), newMemConn()
+	old, added := memShard("old:6379", oldConn), memShard("new:6379", newConn)
+	shards = newRing(old, added)
+
+	var moving, recording, conflicting string
+	for i := 0; conflicting == ""; i++ {
+		name := fmt.Sprintf("/user/stream-%d", i)
+
+		if shards.shard(name) == added {
+			switch {
+			case moving == "":
+				moving = name
+			case recording == "":
+				recording = name
+			default:
+				conflicting = name
+			}
+		}
+	}
+
+	for _, name := range []string{moving, recording, conflicting} {
+		s := &Stream{Name: name, conn: oldConn, segmentSize: 4}
+		if err := s.append([]byte("hello world")); err != nil {
+			t.Fatal(err)
+		}
+
+		if name != recording {
+			if err := s.finish(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// The conflicting stream was recorded again on its new shard.
+	newConn.strings[(&Stream{Name: conflicting}).stateKey()] = []byte(strconv.Itoa(int(Closed)))
+
+	// The moving stream's lease, and keys that aren't a stream's, were left
+	// on the old shard by an earlier deployment.
+	m := &Stream{Name: moving}
+	oldConn.strings[m.leaseKey()] = []byte("lease")
+	oldConn.hashes[m.receivedKey()] = map[string][]byte{"received": []byte("11")}
+	oldConn.zsets[leasesKey()] = map[string]float64{moving: 1000}
+
+	var owner, group string
+	for i := 0; owner == "" || group == ""; i++ {
+		if name := fmt.Sprintf("owner-%d", i); owner == "" && shards.shard(ownerKey(name)) == added {
+			owner = name
+		}
+		if name := fmt.Sprintf("/user/group-%d", i); group == "" && shards.shard(name) == added {
+			group = name
+		}
+	}
+
+	oldConn.zsets[ownerKey(owner)] = map[string]float64{"/" + owner + "/old": 1000}
+	newConn.zsets[ownerKey(owner)] = map[string]float64{"/" + owner + "/new": 2000}
+	oldConn.hashes[groupKey(group)] = map[string][]byte{"state": []byte(strconv.Itoa(int(Closed)))}
+	oldConn.lists[stepsKey(group)] = [][]byte{[]byte("/user/step")}
+
+	var out bytes.Buffer
+	if err := Rebalance(&out, false); err == nil {
+		t.Error("rebalanced without reporting the conflict")
+	}
+
+	if !strings.Contains(out.String(), recording+": old:6379 -> new:6379 skipped") {
+		t.Errorf("open stream wasn't skipped:\n%s", out.String())
+	}
+
+	if !strings.Contains(out.String(), conflicting+": old:6379 -> new:6379 conflict") {
+		t.Errorf("conflicting stream wasn't reported:\n%s", out.String())
+	} else if _, ok := oldConn.strings[(&Stream{Name: conflicting}).dataKey()]; !ok {
+		t.Error("conflicting stream's data was removed from the old shard")
+	}
+
+	r := &Stream{Name: moving, conn: newConn}
+	if state, size, err := r.snapshot(); err != nil {
+		t.Fatal(err)
+	} else if state != Closed || size != 11 {
+		t.Errorf("moved stream is %d bytes in state %d, want 11 bytes closed", size, state)
+	}
+
+	if buf, err := r.readRange(0, 11); err != nil || string(buf) != "hello world" {
+		t.Errorf("moved stream reads %q, %v", buf, err)
+	}
+
+	for key := range oldConn.strings {
+		if strings.Contains(key, moving) {
+			t.Errorf("%s was left on the old shard", key)
+		}
+	}
+
+	if _, ok := oldConn.strings[(&Stream{Name: recording}).stateKey()]; !ok {
+		t.Errorf("open stream was moved")
+	}
+
+	if _, ok := newConn.strings[m.leaseKey()]; !ok {
+		t.Error("lease wasn't moved")
+	}
+	if string(newConn.hashes[m.receivedKey()]["received"]) != "11" {
+		t.Error("received count wasn't moved")
+	}
+	if _, ok := newConn.zsets[leasesKey()][moving]; !ok {
+		t.Error("lease index entry wasn't moved")
+	} else if _, ok := oldConn.zsets[leasesKey()][moving]; ok {
+		t.Error("lease index entry was left on the old shard")
+	}
+
+	if index := newConn.zsets[ownerKey(owner)]; len(index) != 2 {
+		t.Errorf("owner index wasn't merged: %v", index)
+	} else if _, ok := oldConn.zsets[ownerKey(owner)]; ok {
+		t.Error("owner index was left on the old shard")
+	}
+
+	if len(newConn.lists[stepsKey(group)]) != 1 || newConn.hashes[groupKey(group)] == nil {
+		t.Error("group wasn't moved")
+	} else if _, ok := oldConn.hashes[groupKey(group)]; ok {
+		t.Error("group was left on the old shard")
+	}
+}
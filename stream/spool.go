@@ -0,0 +1,409 @@
+package stream
+
+import (
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	spoolDir  string
+	spoolSize int64
+
+	spoolBytes   = expvar.NewInt("spool_bytes")
+	spoolStreams = expvar.NewInt("spool_streams")
+
+	// spooling holds the spools written by recordings in progress, which
+	// replay their own spools.
+	spooling   = make(map[string]bool)
+	spoolingMu sync.Mutex
+
+	// replayFailures holds the failed replays of spools left to the
+	// background, by path.
+	replayFailures = make(map[string]*replayFailure)
+
+	ErrSpoolFull = errors.New("Spool is full")
+)
+
+const (
+	defaultSpoolSize  = 1 << 30
+	spoolInterval     = time.Second
+	maxReplayDelay    = 5 * time.Minute
+	maxReplayFailures = 5 // failures other than redis being unreachable
+
+	spoolHeader = 8 + 32 // the offset and the lease token
+)
+
+// A spool is an on-disk journal of the data a recording couldn't append to
+// redis. It starts with the stream offset of its data, as a big-endian
+// uint64, and the recording's lease token. Once redis is back the recording
+// replays its spool and goes back to appending directly. Spools of recordings
+// that end before then are renamed with a .done extension, and replayed in
+// the background under the recording's lease, finishing their stream. A spool
+// that keeps failing to replay for reasons other than redis being
+// unreachable is renamed with a .failed extension and left alone, as is one
+// whose stream was taken over by another writer.
+// Spool files are named after their stream and a random ID, so that
+// a recording never collides with a spool left over from an earlier one.
+type spool struct {
+	path   string
+	file   *os.File
+	offset int64 // stream offset of the spooled data
+	size   int64
+	tried  time.Time // when the spool was last replayed
+}
+
+func spoolPath(name string) string {
+	return filepath.Join(spoolDir, url.QueryEscape(name)+"."+newID()+".spool")
+}
+
+// spoolName returns the name of the stream whose spool is at path.
+func spoolName(path string) (string, error) {
+	base := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	if i := strings.LastIndex(base, "."); i >= 0 {
+		base = base[:i]
+	}
+
+	return url.QueryUnescape(base)
+}
+
+// A spoolConflict is returned for a spool whose stream was taken over by
+// another writer since it was spooled.
+type spoolConflict string
+
+func (e spoolConflict) Error() string { return string(e) }
+
+func openSpool(name string, offset int64, lease string) (*spool, error) {
+	path := spoolPath(name)
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, spoolHeader)
+	binary.BigEndian.PutUint64(header, uint64(offset))
+	copy(header[8:], lease)
+
+	if _, err := f.Write(header); err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, err
+	}
+
+	spoolingMu.Lock()
+	spooling[path] = true
+	spoolingMu.Unlock()
+
+	spoolStreams.Add(1)
+	spoolBytes.Add(int64(len(header)))
+
+	return &spool{
+		path:   path,
+		file:   f,
+		offset: offset,
+		size:   int64(len(header)),
+		tried:  time.Now(),
+	}, nil
+}
+
+// end returns the stream offset past the spooled data.
+func (sp *spool) end() int64 { return sp.offset + sp.size - spoolHeader }
+
+func (sp *spool) write(buf []byte) error {
+	if spoolBytes.Value()+int64(len(buf)) > spoolSize {
+		return ErrSpoolFull
+	}
+
+	n, err := sp.file.Write(buf)
+	sp.size += int64(n)
+	spoolBytes.Add(int64(n))
+
+	return err
+}
+
+// remove deletes the spool once it's been replayed.
+func (sp *spool) remove() {
+	sp.file.Close()
+	removeSpool(sp.path, sp.size)
+
+	spoolingMu.Lock()
+	delete(spooling, sp.path)
+	spoolingMu.Unlock()
+}
+
+// done hands the spool over to be replayed in the background.
+func (sp *spool) done() error {
+	if err := sp.file.Close(); err != nil {
+		return err
+	}
+
+	err := os.Rename(sp.path, strings.TrimSuffix(sp.path, ".spool")+".done")
+
+	spoolingMu.Lock()
+	delete(spooling, sp.path)
+	spoolingMu.Unlock()
+
+	return err
+}
+
+func removeSpool(path string, size int64) {
+	if err := os.Remove(path); err == nil {
+		spoolStreams.Add(-1)
+		spoolBytes.Add(-size)
+	}
+}
+
+// spoolBatch writes the batch to the stream's spool, and replays the spool
+// every spoolInterval until redis is back.
+func (s *Stream) spoolBatch() error {
+	if err := s.spool.write(s.batch); err != nil {
+		return err
+	}
+	s.batch = s.batch[:0]
+
+	if time.Since(s.spool.tried) < spoolInterval {
+		return nil
+	}
+	s.spool.tried = time.Now()
+
+	if err := s.unspool(false); !transient(err) {
+		return err
+	}
+
+	return nil
+}
+
+// unspool replays the stream's spool on a new connection, finishing the
+// stream if finish is set. The stream appends directly again once it's
+// replayed.
+func (s *Stream) unspool(finish bool) error {
+	s.conn.Close()
+	s.conn = shards.shard(s.Name).servers.get(s.Name)
+
+	if err := s.replay(s.spool.path, finish); err != nil {
+		return err
+	}
+
+	s.spool.remove()
+	s.spool = nil
+
+	return nil
+}
+
+// replay appends the data in the spool at path that isn't stored yet, and
+// finishes the stream if finish is set. A stream without a lease, replaying
+// a spool left to the background, takes over the spooling recording's lease
+// first.
+func (s *Stream) replay(path string, finish bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	header := make([]byte, spoolHeader)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return err
+	}
+	offset := int64(binary.BigEndian.Uint64(header))
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	end := offset + info.Size() - spoolHeader
+
+	if s.lease == "" {
+		if err := s.claim(strings.TrimRight(string(header[8:]), "\x00")); err != nil {
+			return err
+		}
+	}
+
+	r := &Stream{Name: s.Name, conn: s.conn}
+
+	_, size, err := r.snapshot()
+	if err != nil {
+		return err
+	} else if size < offset || size > end {
+		return spoolConflict(fmt.Sprintf("Stream is %d bytes, its spool holds %d to %d", size, offset, end))
+	}
+
+	if size > 0 {
+		s.segmentSize = r.segmentSize
+	}
+	s.size = size
+
+	if _, err := f.Seek(size-offset, io.SeekCurrent); err != nil {
+		return err
+	}
+
+	if err := s.resumeCompression(); err != nil {
+		return err
+	}
+
+	n := flushSize
+	if n <= 0 {
+		n = defaultFlushSize
+	}
+
+	buf := make([]byte, n)
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			if err := s.append(buf[:n]); err != nil {
+				return err
+			}
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if finish {
+		return s.sendFinish()
+	}
+
+	return nil
+}
+
+// claim takes over the lease of the recording with the token, or takes the
+// lease if it has expired, unless another writer holds it.
+func (s *Stream) claim(token string) error {
+	if token == "" {
+		token = newLeaseToken()
+	}
+	s.lease = token
+
+	if leaseTTL <= 0 {
+		return nil
+	}
+
+	err := s.renew()
+	if err == ErrLeaseLost {
+		return spoolConflict("Stream is being recorded by another writer")
+	}
+
+	return err
+}
+
+// loadSpools counts the spools left by a previous process, and replays them
+// and the spools of finished recordings every spoolInterval.
+func loadSpools() {
+	paths, _ := filepath.Glob(filepath.Join(spoolDir, "*"))
+
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil && isSpool(path) {
+			spoolStreams.Add(1)
+			spoolBytes.Add(info.Size())
+		}
+	}
+
+	go func() {
+		for range time.Tick(spoolInterval) {
+			replaySpools()
+		}
+	}()
+}
+
+func isSpool(path string) bool {
+	return strings.HasSuffix(path, ".spool") || strings.HasSuffix(path, ".done")
+}
+
+// A replayFailure tracks the failed replays of a spool, which is tried again
+// with a growing delay.
+type replayFailure struct {
+	permanent int // failures other than redis being unreachable
+	delay     time.Duration
+	next      time.Time
+}
+
+func replaySpools() {
+	paths, _ := filepath.Glob(filepath.Join(spoolDir, "*"))
+
+	for _, path := range paths {
+		spoolingMu.Lock()
+		live := spooling[path]
+		spoolingMu.Unlock()
+
+		if live || !isSpool(path) {
+			continue
+		}
+
+		failure := replayFailures[path]
+		if failure != nil && time.Now().Before(failure.next) {
+			continue
+		}
+
+		name, err := spoolName(path)
+		if err != nil {
+			continue
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+
+		// Spools left by a previous process without a .done extension belong
+		// to recordings that never finished. Their data is still replayed.
+		s := &Stream{Name: name, conn: shards.shard(name).servers.get(name), segmentSize: segmentSize}
+		err = s.replay(path, filepath.Ext(path) == ".done")
+		s.conn.Close()
+
+		if err == nil {
+			delete(replayFailures, path)
+			removeSpool(path, info.Size())
+			continue
+		}
+
+		logger.Printf("Replaying spool %s failed: %s", path, err)
+
+		if _, ok := err.(spoolConflict); ok {
+			delete(replayFailures, path)
+			failSpool(path, info.Size())
+			continue
+		}
+
+		if failure == nil {
+			failure = &replayFailure{delay: spoolInterval}
+			replayFailures[path] = failure
+		} else if failure.delay *= 2; failure.delay > maxReplayDelay {
+			failure.delay = maxReplayDelay
+		}
+		failure.next = time.Now().Add(failure.delay)
+
+		if !transient(err) {
+			failure.permanent++
+		}
+
+		if failure.permanent >= maxReplayFailures {
+			delete(replayFailures, path)
+			failSpool(path, info.Size())
+		}
+	}
+}
+
+// failSpool moves the spool at path aside, so that it's no longer replayed
+// but can still be recovered by hand.
+func failSpool(path string, size int64) {
+	if err := os.Rename(path, path+".failed"); err != nil {
+		logger.Printf("Moving spool %s aside failed: %s", path, err)
+		return
+	}
+
+	logger.Printf("Moved spool %s aside to %s.failed", path, path)
+	spoolStreams.Add(-1)
+	spoolBytes.Add(-size)
+}
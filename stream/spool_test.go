@@ -0,0 +1,226 @@
+package stream
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/htee/hteed/Godeps/_workspace/src/github.com/garyburd/redigo/redis"
+)
+
+func TestSpool(t *testing.T) {
+	defer func(dir string, size int64, r *ring) { spoolDir, spoolSize, shards = dir, size, r }(spoolDir, spoolSize, shards)
+
+	dir, err := ioutil.TempDir("", "hteed-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	spoolDir, spoolSize = dir, 1<<20
+
+	conn := &downConn{memConn: newMemConn(), down: true}
+	p := &redis.Pool{Dial: func() (redis.Conn, error) { return conn, nil }}
+	shards = newRing(newShard("mem:6379", server{p}, nil))
+
+	depth := spoolBytes.Value()
+
+	record := func(name string) *Stream {
+		s := &Stream{Name: name, conn: conn, segmentSize: 4}
+
+		for _, chunk := range []string{"hello", " world"} {
+			s.batch = append(s.batch, chunk...)
+			if err := s.flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		return s
+	}
+
+	check := func(name string) {
+		r := &Stream{Name: name, conn: conn.memConn}
+		if state, size, err := r.snapshot(); err != nil {
+			t.Fatal(err)
+		} else if state != Closed || size != 11 {
+			t.Errorf("%s is %d bytes in state %d, want 11 bytes closed", name, size, state)
+		}
+
+		if buf, err := r.readRange(0, 11); err != nil || string(buf) != "hello world" {
+			t.Errorf("%s reads %q, %v", name, buf, err)
+		}
+	}
+
+	// Redis comes back before the recording ends.
+	s := record("/test/spooled")
+
+	if got := spoolBytes.Value() - depth; got != spoolHeader+11 {
+		t.Errorf("spool holds %d bytes, want %d", got, spoolHeader+11)
+	}
+
+	conn.down = false
+	if err := s.finish(); err != nil {
+		t.Fatal(err)
+	}
+	check(s.Name)
+
+	// Redis comes back after the recording ended.
+	conn.down = true
+	s = record("/test/spooled-done")
+	if err := s.finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	if paths, _ := filepath.Glob(filepath.Join(dir, "*.done")); len(paths) != 1 {
+		t.Errorf("spools handed over for replay: %v, want one", paths)
+	} else if name, err := spoolName(paths[0]); err != nil || name != s.Name {
+		t.Errorf("handed over spool of %q, %v, want %q", name, err, s.Name)
+	}
+
+	// A later recording doesn't collide with the spool left behind.
+	if sp, err := openSpool(s.Name, 11, ""); err != nil {
+		t.Errorf("can't spool the stream again: %v", err)
+	} else {
+		sp.remove()
+	}
+
+	conn.down = false
+	replaySpools()
+	check(s.Name)
+
+	if paths, _ := filepath.Glob(filepath.Join(dir, "*")); len(paths) != 0 {
+		t.Errorf("spools left after replay: %v", paths)
+	}
+
+	if got := spoolBytes.Value(); got != depth {
+		t.Errorf("spool depth is %d after replay, want %d", got, depth)
+	}
+
+	// A spool that can't be replayed is tried again later, and moved aside
+	// once it has failed too often.
+	conn.hashes[(&Stream{Name: "/test/poisoned"}).manifestKey()] = map[string][]byte{"segments": []byte("x")}
+
+	sp, err := openSpool("/test/poisoned", 0, "")
+	if err != nil {
+		t.Fatal(err)
+	} else if err := sp.done(); err != nil {
+		t.Fatal(err)
+	}
+	path := strings.TrimSuffix(sp.path, ".spool") + ".done"
+
+	for i := 0; i < maxReplayFailures; i++ {
+		replaySpools()
+
+		if failure := replayFailures[path]; i < maxReplayFailures-1 && (failure == nil || !failure.next.After(time.Now())) {
+			t.Fatal("failed spool isn't delayed")
+		} else if failure != nil {
+			// The delay has passed.
+			failure.next = time.Time{}
+		}
+	}
+
+	if _, err := os.Stat(path + ".failed"); err != nil {
+		t.Errorf("failed spool wasn't moved aside: %v", err)
+	} else if _, ok := replayFailures[path]; ok {
+		t.Error("failed spool is still tracked")
+	}
+
+	if got := spoolBytes.Value(); got != depth {
+		t.Errorf("spool depth is %d with a failed spool, want %d", got, depth)
+	}
+}
+
+func TestSpoolConflict(t *testing.T) {
+	defer func(dir string, size int64, ttl time.Duration, r *ring) {
+		spoolDir, spoolSize, leaseTTL, shards = dir, size, ttl, r
+	}(spoolDir, spoolSize, leaseTTL, shards)
+
+	dir, err := ioutil.TempDir("", "hteed-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	spoolDir, spoolSize, leaseTTL = dir, 1<<20, time.Minute
+
+	conn := newMemConn()
+	shards = newRing(memShard("mem:6379", conn))
+
+	spoolDone := func(name, lease, data string) string {
+		sp, err := openSpool(name, 5, lease)
+		if err != nil {
+			t.Fatal(err)
+		} else if err := sp.write([]byte(data)); err != nil {
+			t.Fatal(err)
+		} else if err := sp.done(); err != nil {
+			t.Fatal(err)
+		}
+
+		return strings.TrimSuffix(sp.path, ".spool") + ".done"
+	}
+
+	// The recording that spooled still holds its lease, and another writer
+	// holds the lease of a stream it has taken over.
+	for name, lease := range map[string]string{"/test/spooled": "spooler", "/test/taken": "writer"} {
+		s := &Stream{Name: name, conn: conn}
+		if err := s.append([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		conn.strings[s.leaseKey()] = []byte(lease)
+	}
+
+	// Another writer appended past the spooled data of a stream without a
+	// lease.
+	overwritten := &Stream{Name: "/test/overwritten", conn: conn}
+	if err := overwritten.append([]byte("hello, again and again")); err != nil {
+		t.Fatal(err)
+	}
+
+	spooled := spoolDone("/test/spooled", "spooler", " world")
+	taken := spoolDone("/test/taken", "spooler", " world")
+	overwrittenPath := spoolDone("/test/overwritten", "spooler", " world")
+
+	replaySpools()
+
+	r := &Stream{Name: "/test/spooled", conn: conn}
+	if state, size, err := r.snapshot(); err != nil {
+		t.Fatal(err)
+	} else if state != Closed || size != 11 {
+		t.Errorf("spooled stream is %d bytes in state %d, want 11 bytes closed", size, state)
+	} else if _, err := os.Stat(spooled); !os.IsNotExist(err) {
+		t.Errorf("replayed spool was left behind: %v", err)
+	}
+
+	for name, path := range map[string]string{"/test/taken": taken, "/test/overwritten": overwrittenPath} {
+		if _, err := os.Stat(path + ".failed"); err != nil {
+			t.Errorf("spool of %s wasn't moved aside: %v", name, err)
+		}
+	}
+
+	r = &Stream{Name: "/test/taken", conn: conn}
+	if _, size, err := r.snapshot(); err != nil {
+		t.Fatal(err)
+	} else if size != 5 {
+		t.Errorf("taken over stream is %d bytes, want 5", size)
+	}
+}
+
+// downConn is a memConn whose commands fail while redis is down.
+type downConn struct {
+	*memConn
+
+	down bool
+}
+
+func (c *downConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if c.down {
+		c.queue, c.multi = nil, false
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	return c.memConn.Do(cmd, args...)
+}
@@ -1,7 +1,11 @@
 package stream
 
 import (
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"log"
+	"os"
 	"time"
 
 	"github.com/htee/hteed/Godeps/_workspace/src/code.google.com/p/go.net/context"
@@ -15,12 +19,14 @@ type State byte
 const (
 	Closed State = iota
 	Opened
+	Aborted // the writer went away without finishing the stream
 )
 
 var (
-	pool      *redis.Pool
 	keyPrefix string
 	testMode  bool
+
+	logger = log.New(os.Stdout, "[stream] ", log.LstdFlags)
 )
 
 func init() {
@@ -28,29 +34,229 @@ func init() {
 }
 
 func configureStream(cnf *config.Config) error {
-	pool = &redis.Pool{
-		Dial: func() (redis.Conn, error) {
-			return redis.Dial("tcp", cnf.RedisURL)
-		},
-		TestOnBorrow: func(c redis.Conn, t time.Time) error {
-			_, err := c.Do("PING")
+	if err := ConfigureShards(cnf); err != nil {
+		return err
+	}
+
+	leaseTTL = time.Duration(cnf.LeaseTTL) * time.Second
+	if leaseTTL == 0 {
+		leaseTTL = defaultLeaseTTL
+	} else if leaseTTL < 0 {
+		leaseTTL = 0
+	}
+
+	if leaseTTL > 0 {
+		sweeper.Do(func() { go sweepLeases() })
+	}
+
+	resumeTimeout = time.Duration(cnf.ResumeTimeout) * time.Second
+	if resumeTimeout == 0 {
+		resumeTimeout = defaultResumeTimeout
+	}
+
+	writerConflict = cnf.WriterConflict
+	if writerConflict == "" {
+		writerConflict = "reject"
+	} else if !validWriterConflictPolicy(writerConflict) {
+		return fmt.Errorf("Unknown writer-conflict policy %q", writerConflict)
+	}
+
+	writerQueue = time.Duration(cnf.WriterQueueTimeout) * time.Second
+	if writerQueue <= 0 {
+		writerQueue = defaultWriterQueue
+	}
+
+	spoolDir = cnf.SpoolDir
+	spoolSize = int64(cnf.SpoolSize)
+	if spoolSize <= 0 {
+		spoolSize = defaultSpoolSize
+	}
+
+	if spoolDir != "" {
+		if err := os.MkdirAll(spoolDir, 0700); err != nil {
 			return err
-		},
+		}
+
+		loadSpools()
 	}
 
-	conn := pool.Get()
-	defer conn.Close()
+	if cnf.WebhookPath != "" {
+		if err := configureWebhooks(cnf); err != nil {
+			return err
+		}
+	}
 
-	if _, err := conn.Do("PING"); err != nil {
+	watchWebhookHosts = make(map[string]bool)
+	for _, host := range cnf.WatchWebhookHosts {
+		watchWebhookHosts[host] = true
+	}
+
+	patterns, err := compileRedactPatterns(cnf.RedactPatterns, cnf.RedactTokens)
+	if err != nil {
 		return err
 	}
 
-	keyPrefix = cnf.KeyPrefix
+	redactPatterns = patterns
+	redactWindow = cnf.RedactWindow
+	if redactWindow <= 0 {
+		redactWindow = defaultRedactWindow
+	}
+
+	viewerBuffer = cnf.ViewerBuffer
+	if viewerBuffer <= 0 {
+		viewerBuffer = defaultViewerBuffer
+	}
+
+	slowViewer = cnf.SlowViewer
+	if slowViewer == "" {
+		slowViewer = "resync"
+	} else if !validSlowViewerPolicy(slowViewer) {
+		return fmt.Errorf("Unknown slow-viewer policy %q", slowViewer)
+	}
+
+	flushInterval = time.Duration(cnf.FlushInterval) * time.Millisecond
+	if flushInterval <= 0 {
+		flushInterval = defaultFlushInterval
+	}
+
+	flushSize = cnf.FlushSize
+	if flushSize <= 0 {
+		flushSize = defaultFlushSize
+	}
+
+	segmentSize = int64(cnf.SegmentSize)
+	if segmentSize <= 0 {
+		segmentSize = defaultSegmentSize
+	}
+
+	switch cnf.Compression {
+	case "", "none":
+		compression = ""
+	case "gzip":
+		compression = cnf.Compression
+	default:
+		return fmt.Errorf("Unknown compression %q", cnf.Compression)
+	}
+
+	snapshotPage = cnf.SnapshotPage
+	if snapshotPage <= 0 {
+		snapshotPage = defaultSnapshotPage
+	}
+
 	testMode = cnf.Testing
 
 	return nil
 }
 
+// ConfigureShards sets up the connections to the redis shards, and nothing
+// else. It's all an admin command working on the stored streams needs, and
+// unlike a full configuration it starts no background work.
+func ConfigureShards(cnf *config.Config) error {
+	urls := cnf.RedisShards
+	if len(urls) == 0 {
+		urls = []string{cnf.RedisURL}
+	} else if cnf.RedisCluster || len(cnf.RedisSentinels) > 0 {
+		return errors.New("Redis shards can't be combined with Sentinel or Cluster")
+	}
+
+	hashTags = cnf.RedisCluster
+
+	replicas := cnf.RedisReplicas
+	if len(replicas) == 0 {
+		replicas = make([]string, len(urls))
+	} else if len(replicas) != len(urls) {
+		return errors.New("Redis replicas must list one replica per shard")
+	} else if cnf.RedisCluster {
+		return errors.New("Redis replicas can't be combined with Cluster")
+	}
+
+	var all []*shard
+	for i, rawurl := range urls {
+		s, err := configureShard(rawurl, replicas[i], cnf)
+		if err != nil {
+			return err
+		}
+
+		all = append(all, s)
+	}
+
+	shards = newRing(all...)
+
+	retries = cnf.RedisRetries
+	if retries == 0 {
+		retries = defaultRedisRetries
+	}
+
+	delay := time.Duration(cnf.RedisRetryDelay) * time.Millisecond
+	if delay <= 0 {
+		delay = defaultRedisRetryDelay
+	}
+	retryDelay = backoff(delay)
+
+	keyPrefix = cnf.KeyPrefix
+
+	return nil
+}
+
+func configureShard(rawurl, replicaURL string, cnf *config.Config) (*shard, error) {
+	d, err := newDialer(rawurl, cnf)
+	if err != nil {
+		return nil, err
+	}
+
+	var servers backend
+	dialSubscriber := d.dialSubscriber
+
+	switch {
+	case cnf.RedisCluster:
+		c, err := newCluster(d, cnf)
+		if err != nil {
+			return nil, err
+		}
+
+		servers, dialSubscriber = c, c.dialSubscriber
+	case len(cnf.RedisSentinels) > 0:
+		s := newSentinel(d, cnf.RedisSentinels, cnf.RedisSentinelMaster)
+
+		p := newPool(s.dial, cnf)
+		p.TestOnBorrow = checkRole
+
+		servers, dialSubscriber = server{p}, s.dialSubscriber
+	default:
+		servers = server{newPool(d.dial, cnf)}
+	}
+
+	conn := servers.get("")
+	defer conn.Close()
+
+	if _, err := conn.Do("PING"); err != nil {
+		return nil, err
+	}
+
+	s := newShard(d.id(), servers, dialSubscriber)
+
+	if replicaURL != "" {
+		rd, err := newDialer(replicaURL, cnf)
+		if err != nil {
+			return nil, err
+		}
+
+		replica := server{newPool(rd.dial, cnf)}
+
+		conn := replica.get("")
+		defer conn.Close()
+
+		if _, err := conn.Do("PING"); err != nil {
+			return nil, err
+		}
+
+		s.hub = newHub(rd.dialSubscriber, replica.get)
+		s.hub.primary = servers.get
+	}
+
+	return s, nil
+}
+
 func Reset() error {
 	if !testMode {
 		return errors.New("Reset disabled unless testing")
@@ -60,15 +266,18 @@ func Reset() error {
 		return errors.New("Reset requires a key prefix")
 	}
 
-	conn := pool.Get()
+	for _, conn := range primaries() {
+		keys, err := redis.Strings(conn.Do("KEYS", keyPrefix+"*"))
+		if err != nil {
+			conn.Close()
+			return err
+		}
 
-	keys, err := redis.Strings(conn.Do("KEYS", keyPrefix+"*"))
-	if err != nil {
-		return err
-	}
+		for _, key := range keys {
+			conn.Do("DEL", key)
+		}
 
-	for _, key := range keys {
-		conn.Do("DEL", key)
+		conn.Close()
 	}
 
 	return nil
@@ -82,7 +291,7 @@ func newStream(ctx context.Context, name string) *Stream {
 	return &Stream{
 		ctx:  ctx,
 		Name: name,
-		conn: pool.Get(),
+		conn: shards.shard(name).servers.get(name),
 		done: make(chan struct{}),
 	}
 }
@@ -92,6 +301,34 @@ type Stream struct {
 	conn   redis.Conn
 	done   chan struct{}
 	closed bool
+	size   int64
+	batch  []byte
+
+	segmentSize    int64
+	segments       int64
+	compressed     map[int64]bool // segments flagged in the manifest
+	compressedSize int64
+	gz             *compressor
+	cache          []byte
+	cached         int64 // index of the cached segment, plus one
+
+	redactor   *redactor
+	viewer     *viewer
+	markerFeed *viewer
+	spool      *spool
+	lease      string // the writer's lease token
+
+	received  int64 // bytes received from the recorder
+	skip      int64 // bytes the recorder resends on resuming
+	suspended bool
+	final     State // the state the stream finishes in
+
+	scanner  markerScanner
+	watcher  *watcher
+	marks    []Marker // in-band markers waiting to be stored
+	indexed  int64    // when the time index was last added to, in milliseconds
+	created  int64    // when the stream was created, until it's announced
+	reopened int64    // where the ended stream was reopened, until it's announced
 
 	Name string
 	Err  error
@@ -108,7 +345,18 @@ func (s *Stream) close() {
 
 	s.closed = true
 	close(s.done)
-	s.conn.Close()
+
+	if s.viewer != nil {
+		s.viewer.leave()
+	}
+
+	if s.markerFeed != nil {
+		s.markerFeed.leave()
+	}
+
+	if s.conn != nil {
+		s.conn.Close()
+	}
 }
 
 type bufErr struct {
@@ -116,45 +364,292 @@ type bufErr struct {
 	err error
 }
 
+// A message is published on a stream's channel for every change to the
+// stream. It is encoded as the stream state, the offset of the data within
+// the stream as a big-endian uint64, and the data itself.
+type message struct {
+	state  State
+	offset int64
+	buf    []byte
+}
+
+func (m message) encode() []byte {
+	data := make([]byte, 9+len(m.buf))
+	data[0] = byte(m.state)
+	binary.BigEndian.PutUint64(data[1:9], uint64(m.offset))
+	copy(data[9:], m.buf)
+
+	return data
+}
+
+func decodeMessage(data []byte) (message, error) {
+	if len(data) < 9 {
+		return message{}, errors.New("Unrecognized stream message")
+	}
+
+	return message{
+		state:  State(data[0]),
+		offset: int64(binary.BigEndian.Uint64(data[1:9])),
+		buf:    data[9:],
+	}, nil
+}
+
 func (s *Stream) delete() error {
+	held, err := s.heldLease()
+	if err != nil {
+		return err
+	}
+
+	extra := []interface{}{s.watchesKey()}
+	if held {
+		extra = append(extra, s.leaseKey(), s.receivedKey())
+	}
+
+	if err := s.remove(extra...); err != nil {
+		return err
+	}
+
+	if err := s.list("ZREM", s.Name); err != nil {
+		return err
+	}
+
+	if err := s.release(); err != nil {
+		return err
+	}
+
+	return s.announce("deleted")
+}
+
+// clear deletes the stream's data, keeping its writer's lease.
+func (s *Stream) clear() error { return s.remove() }
+
+// remove deletes the stream's state and data along with the extra keys, and
+// closes the stream for its viewers. It fails with ErrLeaseLost if a lease it
+// watched changed.
+func (s *Stream) remove(extra ...interface{}) error {
+	keys, err := s.dataKeys()
+	if err != nil {
+		s.conn.Do("UNWATCH")
+		return err
+	}
+
 	s.conn.Send("MULTI")
-	s.conn.Send("DEL", s.stateKey(), s.dataKey())
-	s.conn.Send("PUBLISH", s.streamKey(), []byte{byte(Closed)})
-	_, err := s.conn.Do("EXEC")
+	s.conn.Send("DEL", append(append([]interface{}{s.stateKey(), s.metaKey(), s.markersKey(), s.timesKey()}, extra...), keys...)...)
+	s.conn.Send("PUBLISH", s.streamKey(), message{Closed, 0, nil}.encode())
+	if reply, err := s.conn.Do("EXEC"); err != nil {
+		return err
+	} else if reply == nil {
+		return ErrLeaseLost
+	}
 
-	return err
+	return nil
 }
 
 func (s *Stream) append(buf []byte) error {
+	if len(buf) == 0 {
+		return nil
+	}
+
+	// The stream is created by its first append.
+	created := s.size == 0
+	now := millis(time.Now())
+
 	s.conn.Send("MULTI")
 	s.conn.Send("SET", s.stateKey(), Opened)
-	s.conn.Send("APPEND", s.dataKey(), buf)
-	s.conn.Send("PUBLISH", s.streamKey(), append([]byte{byte(Opened)}, buf...))
-	_, err := s.conn.Do("EXEC")
+	if created {
+		s.conn.Send("HSET", s.metaKey(), "created", now)
+	}
+	index := now-s.indexed >= int64(timeIndexInterval/time.Millisecond)
+	if index {
+		s.conn.Send("ZADD", s.timesKey(), now, s.size)
+	}
+	s.sendAppend(buf)
+	s.conn.Send("PUBLISH", s.streamKey(), message{Opened, s.size, buf}.encode())
+	if _, err := s.conn.Do("EXEC"); err != nil {
+		return err
+	}
+
+	s.size += int64(len(buf))
+	if index {
+		s.indexed = now
+	}
+	if created {
+		s.created = now
+	}
+	s.announceOpened()
+
+	return nil
+}
+
+// flush appends the batched data to the stream. The batch is kept if the
+// append fails. With a spool, the batch is spooled instead if redis can't be
+// reached.
+func (s *Stream) flush() error {
+	if s.spool != nil {
+		if err := s.spoolBatch(); err != nil {
+			return err
+		}
+
+		return s.storeMarks()
+	}
+
+	// Markers are stored ahead of their data, so that viewers can place them
+	// in it.
+	err := s.attempt(0, s.storeMarks)
+	if err == nil {
+		err = s.attempt(len(s.batch), func() error { return s.append(s.batch) })
+	}
+	if transient(err) && spoolDir != "" {
+		if s.spool, err = openSpool(s.Name, s.size, s.lease); err != nil {
+			return err
+		}
+
+		return s.spoolBatch()
+	} else if err != nil {
+		return err
+	}
+
+	s.batch = s.batch[:0]
+
+	return nil
+}
+
+// end returns the offset past the data stored or spooled so far.
+func (s *Stream) end() int64 {
+	if s.spool != nil {
+		return s.spool.end()
+	}
+
+	return s.size
+}
+
+// attempt runs op once when spooling is enabled, since the data can be
+// spooled instead, and retries it otherwise.
+func (s *Stream) attempt(n int, op func() error) error {
+	if spoolDir != "" {
+		return op()
+	}
+
+	return s.retry(n, op)
+}
+
+// retry runs op, and runs it again on a new connection for as long as it
+// fails on a broken one. n is the number of bytes op appends to the stream.
+// Before op is run again, the stream is checked for whether they were stored
+// before the connection broke, so that they're neither lost nor duplicated.
+func (s *Stream) retry(n int, op func() error) error {
+	err := op()
+
+	for attempt := 1; transient(err) && attempt <= retries; attempt++ {
+		time.Sleep(retryDelay(attempt))
+
+		var stored bool
+		if stored, err = s.recover(n); err == nil && !stored {
+			err = op()
+		}
+	}
 
 	return err
 }
 
-func (s *Stream) subscribe() (state State, buf []byte, err error) {
+// recover replaces the stream's connection, and reports whether the n bytes
+// appended when the old one broke were stored.
+func (s *Stream) recover(n int) (bool, error) {
+	s.conn.Close()
+	s.conn = shards.shard(s.Name).servers.get(s.Name)
+
+	_, size, err := (&Stream{Name: s.Name, conn: s.conn}).snapshot()
+	if err != nil {
+		return false, err
+	}
+
+	stored := false
+	switch {
+	case n > 0 && size == s.size+int64(n):
+		s.size, stored = size, true
+	case size != s.size:
+		return false, fmt.Errorf("Stream is %d bytes, expected %d", size, s.size)
+	}
+
+	return stored, s.resumeCompression()
+}
+
+// snapshot returns the state and size of the stream. The data up to size
+// won't change and can be read in pages with readRange.
+func (s *Stream) snapshot() (state State, size int64, err error) {
 	s.conn.Send("MULTI")
 	s.conn.Send("GET", s.stateKey())
-	s.conn.Send("GET", s.dataKey())
-	s.conn.Send("SUBSCRIBE", s.streamKey())
+	s.conn.Send("HGETALL", s.manifestKey())
+	s.conn.Send("STRLEN", s.dataKey())
+
+	data, err := redis.Values(s.conn.Do("EXEC"))
+	if err != nil {
+		return
+	}
+
+	var manifest []string
+	if _, err = redis.Scan(data, &state, &manifest, &size); err != nil {
+		return
+	}
 
-	if data, err := redis.Values(s.conn.Do("EXEC")); err == nil {
-		_, err = redis.Scan(data, &state, &buf)
+	if err = s.loadManifest(manifest); err != nil {
+		return
 	}
 
+	size, err = s.dataSize(size)
+
 	return
 }
 
+// finish closes the stream. If the stream is spooled, or can't be closed
+// while spooling is enabled, it's finished once its spool is replayed in the
+// background.
 func (s *Stream) finish() error {
+	s.announceOpened()
+
+	if s.spool == nil {
+		err := s.attempt(0, s.sendFinish)
+		if !transient(err) || spoolDir == "" {
+			return err
+		}
+
+		if s.spool, err = openSpool(s.Name, s.size, s.lease); err != nil {
+			return err
+		}
+	} else if err := s.unspool(true); err == nil {
+		return s.storeMarks()
+	}
+
+	return s.spool.done()
+}
+
+func (s *Stream) sendFinish() error {
+	held, err := s.heldLease()
+	if err != nil {
+		return err
+	}
+
 	s.conn.Send("MULTI")
-	s.conn.Send("SET", s.stateKey(), Closed)
-	s.conn.Send("PUBLISH", s.streamKey(), []byte{byte(Closed)})
-	_, err := s.conn.Do("EXEC")
+	s.conn.Send("SET", s.stateKey(), s.final)
+	s.conn.Send("HSET", s.metaKey(), "finished", millis(time.Now()))
+	if held {
+		s.conn.Send("DEL", s.leaseKey(), s.receivedKey())
+	}
+	if s.gz != nil {
+		s.sendSeal(s.size)
+	}
+	s.conn.Send("PUBLISH", s.streamKey(), message{s.final, s.size, nil}.encode())
+	if reply, err := s.conn.Do("EXEC"); err != nil {
+		return err
+	} else if reply == nil {
+		return ErrLeaseLost
+	}
 
-	return err
+	if err := s.release(); err != nil {
+		return err
+	}
+
+	return s.announce(stateNames[s.final])
 }
 
 func (s *Stream) getState() (State, error) {
@@ -163,8 +658,18 @@ func (s *Stream) getState() (State, error) {
 	return State(state), err
 }
 
-func (s *Stream) stateKey() string { return keyPrefix + "state:" + s.Name }
+// key returns the name of the stream's key of the given kind. In a cluster,
+// the stream name is a hash tag so that all of a stream's keys share a slot.
+func (s *Stream) key(kind string) string {
+	if hashTags {
+		return keyPrefix + kind + "{" + s.Name + "}"
+	}
+
+	return keyPrefix + kind + s.Name
+}
+
+func (s *Stream) stateKey() string { return s.key("state:") }
 
-func (s *Stream) dataKey() string { return keyPrefix + "data:" + s.Name }
+func (s *Stream) dataKey() string { return s.key("data:") }
 
-func (s *Stream) streamKey() string { return keyPrefix + s.Name }
+func (s *Stream) streamKey() string { return s.key("") }
@@ -0,0 +1,108 @@
+package stream
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/htee/hteed/Godeps/_workspace/src/github.com/garyburd/redigo/redis"
+)
+
+func TestAppendRetry(t *testing.T) {
+	defer func(n int, d func(int) time.Duration, r *ring, c string) {
+		retries, retryDelay, shards, compression = n, d, r, c
+	}(retries, retryDelay, shards, compression)
+	retries, retryDelay = 3, backoff(time.Millisecond)
+	compression = "gzip"
+
+	for _, applied := range []bool{true, false} {
+		conn := newMemConn()
+		shards = newRing(memShard("mem:6379", conn))
+
+		s := &Stream{Name: "/test/retried", conn: &brokenConn{memConn: conn, applied: applied}, segmentSize: 4}
+
+		for _, chunk := range []string{"hello", " world"} {
+			s.batch = append(s.batch, chunk...)
+			if err := s.flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := s.finish(); err != nil {
+			t.Fatal(err)
+		}
+
+		r := &Stream{Name: s.Name, conn: conn}
+		if state, size, err := r.snapshot(); err != nil {
+			t.Fatal(err)
+		} else if state != Closed || size != 11 {
+			t.Errorf("applied %t: stream is %d bytes in state %d, want 11 bytes closed", applied, size, state)
+		}
+
+		if buf, err := r.readRange(0, 11); err != nil || string(buf) != "hello world" {
+			t.Errorf("applied %t: stream reads %q, %v", applied, buf, err)
+		}
+	}
+}
+
+func TestAnnounceFailure(t *testing.T) {
+	defer func(n int, d func(int) time.Duration, r *ring) {
+		retries, retryDelay, shards = n, d, r
+	}(retries, retryDelay, shards)
+	retries, retryDelay = 3, backoff(time.Millisecond)
+
+	// The owner's index can't be reached when the stream is created.
+	conn := newMemConn()
+	owners := &downConn{memConn: conn, down: true}
+	shards = newRing(newShard("mem:6379", server{&redis.Pool{Dial: func() (redis.Conn, error) { return owners, nil }}}, nil))
+
+	s := &Stream{Name: "/test/announced", conn: conn}
+
+	s.batch = append(s.batch, "hello"...)
+	if err := s.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	owners.down = false
+
+	s.batch = append(s.batch, " world"...)
+	if err := s.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &Stream{Name: s.Name, conn: conn}
+	if _, size, err := r.snapshot(); err != nil {
+		t.Fatal(err)
+	} else if buf, err := r.readRange(0, size); err != nil || string(buf) != "hello world" {
+		t.Errorf("stream reads %q, %v, want %q", buf, err, "hello world")
+	}
+
+	if _, ok := conn.zsets[ownerKey("test")][s.Name]; !ok {
+		t.Error("stream wasn't indexed once its owner's index could be reached")
+	}
+}
+
+// brokenConn is a memConn whose connection breaks on its first EXEC, either
+// after the transaction was applied or before.
+type brokenConn struct {
+	*memConn
+
+	applied bool
+	broken  bool
+}
+
+func (c *brokenConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if cmd != "EXEC" || c.broken {
+		return c.memConn.Do(cmd, args...)
+	}
+
+	c.broken = true
+
+	if c.applied {
+		c.memConn.Do(cmd, args...)
+	} else {
+		c.queue, c.multi = nil, false
+	}
+
+	return nil, io.ErrUnexpectedEOF
+}
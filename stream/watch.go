@@ -0,0 +1,430 @@
+package stream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/htee/hteed/Godeps/_workspace/src/github.com/garyburd/redigo/redis"
+)
+
+var (
+	ErrNoWatch    = errors.New("Watch does not exist")
+	ErrBadPattern = errors.New("Invalid watch pattern")
+	ErrBadWebhook = errors.New("Invalid watch webhook URL")
+
+	alertsSent   = expvar.NewInt("alerts_sent")
+	alertsFailed = expvar.NewInt("alerts_failed")
+
+	webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+	// Watch webhooks are given by users, so they're posted to through a
+	// dialer that refuses private addresses, other than those of the hosts
+	// allowed by watch-webhook-hosts.
+	watchWebhookHosts map[string]bool
+	alertClient       = &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{Dial: dialWatchWebhook},
+	}
+
+	alertQueue   = make(chan Alert, maxQueuedAlerts)
+	alertWorkers sync.Once
+)
+
+const (
+	watchContext = 3    // lines reported on either side of a match
+	maxWatchLine = 4096 // longer lines are matched in parts
+
+	alertPosters    = 4   // workers posting alerts to webhooks
+	maxQueuedAlerts = 256 // alerts waiting to be posted, past which they're dropped
+)
+
+// A Watch is a rule matched against every line recorded into a stream, or
+// into any stream of an owner. A matching line raises an Alert, which is
+// posted to the watch's webhook as JSON, or announced as an "alert" event on
+// the owner's events channel if it has none.
+//
+// The watches of a stream or owner are kept in a hash by ID. A recording
+// checks the watches that exist when it starts.
+type Watch struct {
+	ID      string `json:"id"`
+	Pattern string `json:"pattern"`
+	Webhook string `json:"webhook,omitempty"`
+}
+
+// An Alert reports a line that matched a watch, with the lines around it.
+type Alert struct {
+	Name   string   `json:"name"`
+	Watch  Watch    `json:"watch"`
+	Offset int64    `json:"offset"` // of the matching line
+	Line   string   `json:"line"`
+	Before []string `json:"before"`
+	After  []string `json:"after"`
+}
+
+// watchTarget returns the watches key and a connection for the target, which
+// is a stream name, or an owner's name for the watches on all their streams.
+func watchTarget(target string) (string, redis.Conn) {
+	// A stream's watches are kept with the stream's other keys.
+	if strings.HasPrefix(target, "/") {
+		return (&Stream{Name: target}).watchesKey(), shards.shard(target).servers.get(target)
+	}
+
+	key := keyPrefix + "watches:" + target
+
+	return key, shards.shard(key).servers.conn(key)
+}
+
+func (s *Stream) watchesKey() string { return s.key("watches:") }
+
+// newID returns a random ID, for watches and webhooks.
+func newID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
+
+// AddWatch adds the watch to the target, giving it a new ID.
+func AddWatch(target string, w Watch) (Watch, error) {
+	if _, err := regexp.Compile(w.Pattern); err != nil || w.Pattern == "" {
+		return w, ErrBadPattern
+	}
+
+	if w.Webhook != "" {
+		u, err := url.Parse(w.Webhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return w, ErrBadWebhook
+		}
+
+		if _, err := watchWebhookAddrs(u.Hostname()); err != nil {
+			return w, ErrBadWebhook
+		}
+	}
+
+	w.ID = newID()
+
+	data, err := json.Marshal(w)
+	if err != nil {
+		return w, err
+	}
+
+	key, conn := watchTarget(target)
+	defer conn.Close()
+
+	_, err = conn.Do("HSET", key, w.ID, data)
+
+	return w, err
+}
+
+// RemoveWatch removes the target's watch with the ID.
+func RemoveWatch(target, id string) error {
+	key, conn := watchTarget(target)
+	defer conn.Close()
+
+	if removed, err := redis.Bool(conn.Do("HDEL", key, id)); err != nil {
+		return err
+	} else if !removed {
+		return ErrNoWatch
+	}
+
+	return nil
+}
+
+// Watches returns the target's watches.
+func Watches(target string) ([]Watch, error) {
+	key, conn := watchTarget(target)
+	defer conn.Close()
+
+	fields, err := redis.Values(conn.Do("HGETALL", key))
+	if err != nil {
+		return nil, err
+	}
+
+	watches := make([]Watch, 0, len(fields)/2)
+	for i := 1; i < len(fields); i += 2 {
+		var w Watch
+		if err := json.Unmarshal(fields[i].([]byte), &w); err != nil {
+			return nil, err
+		}
+		watches = append(watches, w)
+	}
+
+	return watches, nil
+}
+
+// A watcher matches the lines of a recording against its watches. Alerts
+// are held until the lines after the match are recorded, the recording goes
+// idle, or it ends. A nil watcher has no watches.
+type watcher struct {
+	name    string
+	watches []Watch
+	res     []*regexp.Regexp
+
+	line    []byte // the line being recorded
+	offset  int64  // offset of the line being recorded
+	before  []string
+	pending []*Alert
+}
+
+// loadWatcher returns a watcher for the watches on the named stream and on
+// its owner, or nil if there are none.
+func loadWatcher(name string) (*watcher, error) {
+	if shards == nil {
+		return nil, nil
+	}
+
+	watches, err := Watches(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if o := owner(name); o != "" {
+		owned, err := Watches(o)
+		if err != nil {
+			return nil, err
+		}
+		watches = append(watches, owned...)
+	}
+
+	if len(watches) == 0 {
+		return nil, nil
+	}
+
+	w := &watcher{name: name}
+	for _, watch := range watches {
+		re, err := regexp.Compile(watch.Pattern)
+		if err != nil {
+			continue
+		}
+
+		w.watches = append(w.watches, watch)
+		w.res = append(w.res, re)
+	}
+
+	return w, nil
+}
+
+// scan matches the complete lines of the data recorded at offset, and
+// returns the alerts whose lines after the match are all recorded.
+func (w *watcher) scan(buf []byte, offset int64) []Alert {
+	if w == nil {
+		return nil
+	}
+
+	var ready []Alert
+	for len(buf) > 0 {
+		if len(w.line) == 0 {
+			w.offset = offset
+		}
+
+		i := bytes.IndexByte(buf, '\n')
+		n := i
+		if i < 0 {
+			n = len(buf)
+		}
+		if room := maxWatchLine - len(w.line); n > room {
+			n = room
+		}
+		w.line = append(w.line, buf[:n]...)
+
+		complete := n == i
+		if complete {
+			n++
+		}
+		buf, offset = buf[n:], offset+int64(n)
+
+		if !complete && len(w.line) < maxWatchLine {
+			break
+		}
+
+		ready = append(ready, w.match()...)
+		w.line = w.line[:0]
+	}
+
+	return ready
+}
+
+// match matches the line against the watches, adding it to the pending
+// alerts as context, and returns the alerts it completes.
+func (w *watcher) match() []Alert {
+	line := strings.TrimSuffix(string(w.line), "\r")
+
+	var ready []Alert
+	pending := w.pending[:0]
+	waiting := make(map[string]bool)
+
+	for _, a := range w.pending {
+		waiting[a.Watch.ID] = true
+
+		a.After = append(a.After, line)
+		if len(a.After) == watchContext {
+			ready = append(ready, *a)
+		} else {
+			pending = append(pending, a)
+		}
+	}
+	w.pending = pending
+
+	for i, re := range w.res {
+		// Matches reported in a pending alert's context don't raise their own.
+		if waiting[w.watches[i].ID] || !re.MatchString(line) {
+			continue
+		}
+
+		w.pending = append(w.pending, &Alert{
+			Name:   w.name,
+			Watch:  w.watches[i],
+			Offset: w.offset,
+			Line:   line,
+			Before: append([]string{}, w.before...),
+			After:  []string{},
+		})
+	}
+
+	w.before = append(w.before, line)
+	if len(w.before) > watchContext {
+		w.before = w.before[1:]
+	}
+
+	return ready
+}
+
+// waiting reports whether alerts are held for the lines after their match.
+func (w *watcher) waiting() bool { return w != nil && len(w.pending) > 0 }
+
+// expire returns the pending alerts with the context recorded so far.
+func (w *watcher) expire() []Alert {
+	if w == nil {
+		return nil
+	}
+
+	ready := make([]Alert, 0, len(w.pending))
+	for _, a := range w.pending {
+		ready = append(ready, *a)
+	}
+	w.pending = nil
+
+	return ready
+}
+
+// flush matches the last line, even if it's incomplete, and returns every
+// alert left.
+func (w *watcher) flush() []Alert {
+	if w == nil {
+		return nil
+	}
+
+	var ready []Alert
+	if len(w.line) > 0 {
+		ready = w.match()
+		w.line = nil
+	}
+
+	return append(ready, w.expire()...)
+}
+
+// batchData adds the data to the batch, checking it against the watches.
+func (s *Stream) batchData(data []byte) {
+	s.alert(s.watcher.scan(data, s.end()+int64(len(s.batch))))
+	s.batch = append(s.batch, data...)
+}
+
+// alert sends the alerts, queueing them to be posted to their watch's webhook
+// in the background. Alerts that can't be sent, or don't fit in the queue,
+// are counted, but don't fail the recording.
+func (s *Stream) alert(alerts []Alert) {
+	for _, a := range alerts {
+		if a.Watch.Webhook != "" {
+			alertWorkers.Do(startAlertPosters)
+
+			select {
+			case alertQueue <- a:
+			default:
+				alertsFailed.Add(1)
+			}
+		} else if err := s.publish(Event{Type: "alert", Name: s.Name, Size: s.size, Alert: &a}); err != nil {
+			alertsFailed.Add(1)
+		} else {
+			alertsSent.Add(1)
+		}
+	}
+}
+
+func startAlertPosters() {
+	for i := 0; i < alertPosters; i++ {
+		go func() {
+			for a := range alertQueue {
+				postAlert(a)
+			}
+		}()
+	}
+}
+
+func postAlert(a Alert) {
+	data, err := json.Marshal(a)
+	if err != nil {
+		alertsFailed.Add(1)
+		return
+	}
+
+	res, err := alertClient.Post(a.Watch.Webhook, "application/json", bytes.NewReader(data))
+	if err != nil {
+		alertsFailed.Add(1)
+		return
+	}
+	res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		alertsFailed.Add(1)
+		return
+	}
+
+	alertsSent.Add(1)
+}
+
+// watchWebhookAddrs returns the addresses of a watch webhook's host, which
+// must all be public unless the host is allowed.
+func watchWebhookAddrs(host string) ([]net.IP, error) {
+	ips, err := net.LookupIP(host)
+	if err != nil || watchWebhookHosts[host] {
+		return ips, err
+	}
+
+	for _, ip := range ips {
+		if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+			ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+			return nil, ErrBadWebhook
+		}
+	}
+
+	return ips, nil
+}
+
+// dialWatchWebhook connects to the checked address of a watch webhook's host,
+// so that the host can't resolve to a private address once it's checked.
+func dialWatchWebhook(network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := watchWebhookAddrs(host)
+	if err != nil {
+		return nil, err
+	} else if len(ips) == 0 {
+		return nil, ErrBadWebhook
+	}
+
+	return net.DialTimeout(network, net.JoinHostPort(ips[0].String(), port), 10*time.Second)
+}
@@ -0,0 +1,138 @@
+package stream
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestWatcher(t *testing.T) {
+	w := &watcher{name: "/alice/deploy"}
+	for _, pattern := range []string{"FATAL", "^done"} {
+		w.watches = append(w.watches, Watch{ID: pattern, Pattern: pattern})
+		w.res = append(w.res, regexp.MustCompile(pattern))
+	}
+
+	var alerts []Alert
+	offset := int64(0)
+	for i, chunk := range []string{"one\ntwo\nthree\nfour\nFA", "TAL: disk\r\nFATAL again\nfive\n", "six\ndone"} {
+		alerts = append(alerts, w.scan([]byte(chunk), offset)...)
+		offset += int64(len(chunk))
+
+		if i == 1 && (!w.waiting() || len(alerts) > 0) {
+			t.Error("watcher isn't waiting for the lines after the match")
+		}
+	}
+
+	alerts = append(alerts, w.flush()...)
+
+	want := []Alert{
+		{
+			Name:   "/alice/deploy",
+			Watch:  Watch{ID: "FATAL", Pattern: "FATAL"},
+			Offset: 19,
+			Line:   "FATAL: disk",
+			Before: []string{"two", "three", "four"},
+			After:  []string{"FATAL again", "five", "six"},
+		},
+		{
+			Name:   "/alice/deploy",
+			Watch:  Watch{ID: "^done", Pattern: "^done"},
+			Offset: 53,
+			Line:   "done",
+			Before: []string{"FATAL again", "five", "six"},
+			After:  []string{},
+		},
+	}
+	if !reflect.DeepEqual(alerts, want) {
+		t.Errorf("alerts are %+v, want %+v", alerts, want)
+	}
+
+	var nilWatcher *watcher
+	if nilWatcher.scan([]byte("FATAL\n"), 0) != nil || nilWatcher.waiting() || nilWatcher.flush() != nil {
+		t.Error("nil watcher raised alerts")
+	}
+}
+
+func TestWatches(t *testing.T) {
+	defer func(r *ring) { shards = r }(shards)
+
+	conn := newMemConn()
+	shards = newRing(memShard("mem:6379", conn))
+
+	if _, err := AddWatch("alice", Watch{Pattern: "FATAL("}); err != ErrBadPattern {
+		t.Errorf("added a bad pattern with %v, want ErrBadPattern", err)
+	}
+	for _, webhook := range []string{"ftp://example.com", "http://127.0.0.1:8080/", "http://169.254.169.254/latest", "http://[::1]/"} {
+		if _, err := AddWatch("alice", Watch{Pattern: "FATAL", Webhook: webhook}); err != ErrBadWebhook {
+			t.Errorf("added webhook %s with %v, want ErrBadWebhook", webhook, err)
+		}
+	}
+
+	// The test webhook is local.
+	defer func(hosts map[string]bool) { watchWebhookHosts = hosts }(watchWebhookHosts)
+	watchWebhookHosts = map[string]bool{"127.0.0.1": true}
+
+	posted := make(chan Alert, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		var a Alert
+		json.NewDecoder(req.Body).Decode(&a)
+		posted <- a
+	}))
+	defer hook.Close()
+
+	owned, err := AddWatch("alice", Watch{Pattern: "FATAL"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hooked, err := AddWatch("/alice/deploy", Watch{Pattern: "panic", Webhook: hook.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if watches, err := Watches("alice"); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(watches, []Watch{owned}) {
+		t.Errorf("owner watches are %+v, want %+v", watches, []Watch{owned})
+	}
+
+	s := &Stream{Name: "/alice/deploy", conn: conn}
+	if s.watcher, err = loadWatcher(s.Name); err != nil {
+		t.Fatal(err)
+	}
+
+	s.queue([]byte("FATAL: disk\npanic: oops\n"))
+	s.alert(s.watcher.flush())
+
+	var events []Event
+	for _, data := range conn.messages[eventsKey("alice")] {
+		var event Event
+		if err := json.Unmarshal(data, &event); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+
+	if len(events) != 1 || events[0].Type != "alert" || events[0].Alert.Line != "FATAL: disk" {
+		t.Errorf("announced %+v, want an alert for the FATAL line", events)
+	}
+
+	select {
+	case a := <-posted:
+		if a.Watch != hooked || a.Line != "panic: oops" || a.Offset != 12 {
+			t.Errorf("posted %+v, want an alert for the panic line", a)
+		}
+	case <-time.After(time.Second):
+		t.Error("alert wasn't posted to the webhook")
+	}
+
+	if err := RemoveWatch("alice", owned.ID); err != nil {
+		t.Error(err)
+	} else if err := RemoveWatch("alice", owned.ID); err != ErrNoWatch {
+		t.Errorf("removed the watch twice with %v, want ErrNoWatch", err)
+	}
+}